@@ -2,41 +2,173 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"sensord/internal/admin_api"
 	"sensord/internal/core"
 	"sensord/internal/db"
+	"sensord/internal/health"
+	"sensord/internal/logging"
+	"sensord/internal/metrics"
 	"sensord/internal/sensor_api"
+	"sensord/internal/sensor_status"
+	"sensord/internal/tracing"
+	"syscall"
 )
 
-// main start the sensord
+// main start the sensord or run the `sensord config check` command
 func main() {
-	// Listen to interrupt signal Ctrl+C
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	// Load config from envs
-	conf := core.LoadConfig()
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "check" {
+		os.Exit(checkConfig(args[2:]))
+	}
+	// Listen to interrupt signal Ctrl+C and SIGTERM from Docker
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// log the configuration errors as JSON too
+	logging.Init(slog.LevelInfo)
+	// Load config from the file, envs and flags
+	conf, confErr := core.LoadConfig(args)
+	if errors.Is(confErr, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if confErr != nil {
+		logging.Fatal("Invalid configuration", "err", confErr)
+	}
+	logging.Level.Set(conf.LogLevel)
 
-	log.Printf("INFO: Running Sensor Daemon on %s\n", conf.SensorApiListenHttp)
+	slog.Info("Running Sensor Daemon", "addr", conf.SensorApiListenHttp)
+
+	shutdownTracing, tracingErr := tracing.Init(ctx, conf.TracingExporter, conf.TracingSampleRatio)
+	if tracingErr != nil {
+		logging.Fatal("Unable to start tracing", "err", tracingErr)
+	}
 
-	storage := db.NewPostgresDb(conf.DatabaseUrl, conf.DatabaseLog)
+	storage := db.NewPostgresDb(conf.DatabaseUrl, conf.DatabaseMaxConns, conf.DatabaseMigrationsTable)
 	dbErr := storage.Connect(ctx)
 	if dbErr != nil {
-		log.Fatal("CRIT: Unable to connect to database: " + dbErr.Error())
+		logging.Fatal("Unable to connect to database", "err", dbErr)
 	}
-	defer storage.Close()
+	metrics.Registry.MustRegister(storage.PoolCollector())
 
+	// the config file is read again on reload. Envs and flags of the process stay the same.
+	reloader := core.NewReloader(conf, func() (*core.SensordConf, error) {
+		return core.LoadConfig(args)
+	})
+	// sensors status is shared between the APIs
+	registry := sensor_status.NewRegistry()
 	// start Sensor API server endpoints
-	sensorApiServ := sensor_api.NewSensorApiServer(conf.SensorApiListenHttp, storage)
+	sensorApiServ := sensor_api.NewSensorApiServer(conf, storage, registry)
 	go sensorApiServ.Start()
 	// start Admin API server endpoints
-	adminApiServ := admin_api.NewAdminApiServer(conf.AdminApiListenHttp, storage)
+	sensordHealth := newHealth(storage, sensorApiServ)
+	adminApiServ := admin_api.NewAdminApiServer(conf, storage, registry, sensordHealth, reloader)
 	go adminApiServ.Start()
+	reloader.Add(sensorApiServ, adminApiServ, logLevelReloader(conf.LogLevel))
+	reloadOnSighup(ctx, reloader)
 
-	// Wait until the main context is canceled by Ctrl+C
+	// Wait until the main context is canceled by Ctrl+C or SIGTERM
 	<-ctx.Done()
-	log.Println("INFO: Gracefully shutting down")
+	slog.Info("Gracefully shutting down")
 	stop()
+	// a load balancer stops sending new requests while the in-flight are drained
+	sensordHealth.SetDraining()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	// stop the ingestion first while the Admin API still serves
+	err := sensorApiServ.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Sensor API server shutdown", "err", err)
+	}
+	err = adminApiServ.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Admin API server shutdown", "err", err)
+	}
+	// no requests use the DB anymore
 	storage.Close()
+	// flush spans of the drained requests
+	err = shutdownTracing(shutdownCtx)
+	if err != nil {
+		slog.Warn("Tracing shutdown", "err", err)
+	}
+	slog.Info("Stopped")
+}
+
+// reloadOnSighup reloads the config on each SIGHUP until the ctx is done.
+// The signal is subscribed before returning so an early SIGHUP doesn't kill the process.
+func reloadOnSighup(ctx context.Context, reloader *core.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				changes, err := reloader.Reload()
+				if err != nil {
+					slog.Error("Config reload failed, the old config is kept", "err", err)
+					continue
+				}
+				slog.Warn("Config reloaded", "applied", changes.Applied, "restart_required", changes.RestartRequired)
+			}
+		}
+	}()
+}
+
+// logLevelReloader sets the level only if it's changed in the config
+// so a level set at runtime by the Admin API isn't reset by a reload of other settings
+func logLevelReloader(level slog.Level) core.Reloadable {
+	return core.ReloadFunc(func(conf *core.SensordConf) (func(), error) {
+		return func() {
+			if conf.LogLevel != level {
+				level = conf.LogLevel
+				logging.Level.Set(level)
+			}
+		}, nil
+	})
+}
+
+// checkConfig validates the config and prints the effective one with secrets redacted.
+// Returns the exit code: non-zero if the config is invalid.
+func checkConfig(args []string) int {
+	conf, err := core.LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		return 1
+	}
+	err = conf.WriteYaml(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to print the configuration:", err)
+		return 1
+	}
+	return 0
+}
+
+// newHealth checks readiness of the DB, its schema and the ingestion
+func newHealth(storage db.SensorsDb, sensorApiServ *sensor_api.SensorApiServer) *health.Health {
+	h := health.NewHealth()
+	h.AddCheck("db", storage.Ping)
+	h.AddCheck("migrations", func(ctx context.Context) error {
+		version, dirty, err := storage.GetSchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("migration %d failed", version)
+		}
+		if version != db.SchemaVersion {
+			return fmt.Errorf("schema version %d, expected %d", version, db.SchemaVersion)
+		}
+		return nil
+	})
+	h.AddCheck("ingestion", sensorApiServ.CheckSaturation)
+	return h
 }
@@ -0,0 +1,55 @@
+package admin_api
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net/http"
+	"sensord/internal/certs"
+	"sensord/internal/core"
+	"sensord/internal/models"
+)
+
+// handleConfigReload reloads the config like the SIGHUP does.
+// Responds with the applied settings and the ones that need a restart, or 422 with the error if the new config is invalid.
+func (s *AdminApiServer) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	username := adminUserFrom(r.Context()).Username
+	status := http.StatusOK
+	result := &models.ConfigReloadDto{}
+	changes, err := s.reloader.Reload()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Config reload failed", "by", username, "err", err)
+		status = http.StatusUnprocessableEntity
+		result.Error = err.Error()
+	} else {
+		slog.WarnContext(r.Context(), "Config reloaded", "by", username,
+			"applied", changes.Applied, "restart_required", changes.RestartRequired)
+		result.Applied = changes.Applied
+		result.RestartRequired = changes.RestartRequired
+	}
+	jsonBody, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(jsonBody)
+}
+
+// PrepareReload the TLS certificate. New TLS handshakes get it while open connections are kept.
+func (s *AdminApiServer) PrepareReload(conf *core.SensordConf) (func(), error) {
+	if (conf.AdminTlsCert != "") != (s.tlsCerts != nil) {
+		return nil, errors.New("ADMIN_TLS_CERT: TLS can't be enabled or disabled without a restart")
+	}
+	if s.tlsCerts == nil {
+		return func() {}, nil
+	}
+	tlsConfig, err := certs.Load(conf.AdminTlsCert, conf.AdminTlsKey, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "Admin API")
+	}
+	return func() {
+		s.tlsCerts.Set(tlsConfig)
+	}, nil
+}
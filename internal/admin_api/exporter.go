@@ -0,0 +1,178 @@
+package admin_api
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"sensord/internal/db"
+	"sensord/internal/models"
+	"sensord/internal/sensor_status"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	sensorValueDesc = prometheus.NewDesc("sensord_sensor_value",
+		"The latest value of the sensor's metric.", []string{"sensor_id", "metric", "unit"}, nil)
+	sensorTodayMinDesc = prometheus.NewDesc("sensord_sensor_today_min",
+		"Today's minimal value of the sensor's metric.", []string{"sensor_id", "metric", "unit"}, nil)
+	sensorTodayMaxDesc = prometheus.NewDesc("sensord_sensor_today_max",
+		"Today's maximal value of the sensor's metric.", []string{"sensor_id", "metric", "unit"}, nil)
+	sensorTodayAvgDesc = prometheus.NewDesc("sensord_sensor_today_avg",
+		"Today's average value of the sensor's metric.", []string{"sensor_id", "metric", "unit"}, nil)
+	sensorTodayCountDesc = prometheus.NewDesc("sensord_sensor_today_count",
+		"Today's number of measurements of the sensor's metric.", []string{"sensor_id", "metric"}, nil)
+	droppedSensorsDesc = prometheus.NewDesc("sensord_sensor_exporter_dropped_sensors",
+		"Sensors over the EXPORTER_MAX_SENSORS that are not exported.", nil, nil)
+)
+
+// exporterQueryTimeout of the today's stats query
+const exporterQueryTimeout = 10 * time.Second
+
+// sensorExporter serves the latest value and today's aggregates of each sensor as Prometheus gauges.
+// A snapshot is cached for the ttl so frequent scrapes of many Prometheus replicas don't query the DB each time.
+type sensorExporter struct {
+	storage    db.SensorsDb
+	registry   *sensor_status.Registry
+	maxSensors int
+	ttl        time.Duration
+	// mu serializes refreshes so concurrent scrapes of an expired snapshot make one query
+	mu       sync.Mutex
+	snapshot *exporterSnapshot
+}
+
+// exporterSnapshot of sensors values limited by the maxSensors
+type exporterSnapshot struct {
+	takenAt  time.Time
+	statuses []*models.SensorStatus
+	today    []*models.MeasurementRec
+	dropped  int
+}
+
+func newSensorExporter(storage db.SensorsDb, registry *sensor_status.Registry, maxSensors int, ttl time.Duration) *sensorExporter {
+	return &sensorExporter{
+		storage:    storage,
+		registry:   registry,
+		maxSensors: maxSensors,
+		ttl:        ttl,
+	}
+}
+
+// handleSensorMetrics serves the sensors the user can see in the Prometheus text or the OpenMetrics format
+func (e *sensorExporter) handleSensorMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot, err := e.getSnapshot(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to export sensors", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&snapshotCollector{snapshot: snapshot, user: adminUserFrom(r.Context())})
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+}
+
+// getSnapshot returns the cached snapshot or takes a new one if it's expired.
+// If the DB fails then the stale snapshot is served.
+func (e *sensorExporter) getSnapshot(ctx context.Context) (*exporterSnapshot, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.snapshot != nil && time.Since(e.snapshot.takenAt) < e.ttl {
+		return e.snapshot, nil
+	}
+	snapshot, err := e.takeSnapshot(ctx)
+	if err != nil {
+		if e.snapshot != nil {
+			slog.WarnContext(ctx, "Serve a stale snapshot of sensors", "err", err)
+			return e.snapshot, nil
+		}
+		return nil, err
+	}
+	e.snapshot = snapshot
+	return snapshot, nil
+}
+
+// takeSnapshot of the sensors seen since start and the sensors with measurements today.
+// Only the maxSensors with the lowest ids are kept.
+func (e *sensorExporter) takeSnapshot(ctx context.Context) (*exporterSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, exporterQueryTimeout)
+	defer cancel()
+	today := time.Now().Truncate(24 * time.Hour)
+	todayStats, err := e.storage.GetMeasurementPeriodStatsForEachSensor(ctx, today, today.AddDate(0, 0, 1), nil)
+	if err != nil {
+		return nil, err
+	}
+	statuses := e.registry.List()
+
+	sensorIds := map[int]bool{}
+	for _, status := range statuses {
+		sensorIds[status.SensorId] = true
+	}
+	for _, rec := range todayStats {
+		sensorIds[rec.SensorId] = true
+	}
+	ids := make([]int, 0, len(sensorIds))
+	for sensorId := range sensorIds {
+		ids = append(ids, sensorId)
+	}
+	sort.Ints(ids)
+	snapshot := &exporterSnapshot{takenAt: time.Now()}
+	if len(ids) > e.maxSensors {
+		snapshot.dropped = len(ids) - e.maxSensors
+		for _, sensorId := range ids[e.maxSensors:] {
+			delete(sensorIds, sensorId)
+		}
+	}
+	for _, status := range statuses {
+		if sensorIds[status.SensorId] {
+			snapshot.statuses = append(snapshot.statuses, status)
+		}
+	}
+	for _, rec := range todayStats {
+		if sensorIds[rec.SensorId] {
+			snapshot.today = append(snapshot.today, rec)
+		}
+	}
+	return snapshot, nil
+}
+
+// snapshotCollector exports the snapshot of the sensors the user can see
+type snapshotCollector struct {
+	snapshot *exporterSnapshot
+	user     *models.AdminUser
+}
+
+// Describe nothing: the collector is unchecked because the sensors are not known in advance
+func (c *snapshotCollector) Describe(_ chan<- *prometheus.Desc) {
+}
+
+func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.snapshot.statuses {
+		if !c.user.CanSeeSensor(status.SensorId) {
+			continue
+		}
+		sensorId := strconv.Itoa(status.SensorId)
+		for metric, value := range status.LastValues {
+			ch <- prometheus.MustNewConstMetric(sensorValueDesc, prometheus.GaugeValue, value, sensorId, metric, models.MetricUnits[metric])
+		}
+	}
+	for _, rec := range c.snapshot.today {
+		if !c.user.CanSeeSensor(rec.SensorId) {
+			continue
+		}
+		sensorId := strconv.Itoa(rec.SensorId)
+		unit := models.MetricUnits[rec.Metric]
+		ch <- prometheus.MustNewConstMetric(sensorTodayMinDesc, prometheus.GaugeValue, rec.MinValue, sensorId, rec.Metric, unit)
+		ch <- prometheus.MustNewConstMetric(sensorTodayMaxDesc, prometheus.GaugeValue, rec.MaxValue, sensorId, rec.Metric, unit)
+		ch <- prometheus.MustNewConstMetric(sensorTodayAvgDesc, prometheus.GaugeValue, rec.AvgValue, sensorId, rec.Metric, unit)
+		ch <- prometheus.MustNewConstMetric(sensorTodayCountDesc, prometheus.GaugeValue, float64(rec.TotalCount), sensorId, rec.Metric)
+	}
+	ch <- prometheus.MustNewConstMetric(droppedSensorsDesc, prometheus.GaugeValue, float64(c.snapshot.dropped))
+}
@@ -0,0 +1,91 @@
+package admin_api
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sensord/internal/db"
+	"sensord/internal/models"
+	"sensord/internal/sensor_status"
+	"testing"
+	"time"
+)
+
+// fakeStatsDb returns today's stats and counts queries
+type fakeStatsDb struct {
+	db.SensorsDb
+	stats   []*models.MeasurementRec
+	err     error
+	queries int
+}
+
+func (f *fakeStatsDb) GetMeasurementPeriodStatsForEachSensor(_ context.Context, _, _ time.Time, _ *models.StatsFilter) ([]*models.MeasurementRec, error) {
+	f.queries++
+	return f.stats, f.err
+}
+
+func scrapeSensors(exporter *sensorExporter, user *models.AdminUser) (int, string) {
+	r := httptest.NewRequest(http.MethodGet, "/metrics/sensors", nil)
+	r = r.WithContext(withAdminUser(r.Context(), user))
+	w := httptest.NewRecorder()
+	exporter.handleSensorMetrics(w, r)
+	return w.Code, w.Body.String()
+}
+
+func Test_sensorExporter_handleSensorMetrics(t *testing.T) {
+	now := time.Now()
+	registry := sensor_status.NewRegistry()
+	registry.Observe(1, now, now, 0)
+	registry.ObserveValue(1, "temperature", 21.5)
+	registry.Observe(2, now, now, 0)
+	registry.ObserveValue(2, "humidity", 40)
+	storage := &fakeStatsDb{stats: []*models.MeasurementRec{
+		{SensorId: 1, Metric: "temperature", TotalCount: 3, AvgValue: 20, MinValue: 19, MaxValue: 21.5},
+		{SensorId: 3, Metric: "temperature", TotalCount: 1, AvgValue: 10, MinValue: 10, MaxValue: 10},
+	}}
+	exporter := newSensorExporter(storage, registry, 2, time.Minute)
+
+	status, body := scrapeSensors(exporter, anonymousUser(models.RoleViewer))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `sensord_sensor_value{metric="temperature",sensor_id="1",unit="celsius"} 21.5`)
+	assert.Contains(t, body, `sensord_sensor_value{metric="humidity",sensor_id="2",unit="percent"} 40`)
+	assert.Contains(t, body, `sensord_sensor_today_min{metric="temperature",sensor_id="1",unit="celsius"} 19`)
+	assert.Contains(t, body, `sensord_sensor_today_max{metric="temperature",sensor_id="1",unit="celsius"} 21.5`)
+	assert.Contains(t, body, `sensord_sensor_today_avg{metric="temperature",sensor_id="1",unit="celsius"} 20`)
+	assert.Contains(t, body, `sensord_sensor_today_count{metric="temperature",sensor_id="1"} 3`)
+	// the sensor 3 is over the cap
+	assert.NotContains(t, body, `sensor_id="3"`)
+	assert.Contains(t, body, `sensord_sensor_exporter_dropped_sensors 1`)
+
+	// the viewer sees only own sensors
+	viewer := &models.AdminUser{Username: "yochbad", Role: models.RoleViewer, SensorIds: []int{2}}
+	status, body = scrapeSensors(exporter, viewer)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, `sensor_id="1"`)
+	assert.Contains(t, body, `sensor_id="2"`)
+
+	// the snapshot is cached
+	assert.Equal(t, 1, storage.queries)
+}
+
+func Test_sensorExporter_getSnapshot_Stale(t *testing.T) {
+	storage := &fakeStatsDb{err: errors.New("connection refused")}
+	exporter := newSensorExporter(storage, sensor_status.NewRegistry(), 10, 0)
+	status, _ := scrapeSensors(exporter, anonymousUser(models.RoleViewer))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	storage.err = nil
+	storage.stats = []*models.MeasurementRec{{SensorId: 1, Metric: "co2", TotalCount: 1, AvgValue: 400, MinValue: 400, MaxValue: 400}}
+	status, body := scrapeSensors(exporter, anonymousUser(models.RoleViewer))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `sensord_sensor_today_avg{metric="co2",sensor_id="1",unit="ppm"} 400`)
+
+	// the DB fails again but the last snapshot is served
+	storage.err = errors.New("connection refused")
+	status, body = scrapeSensors(exporter, anonymousUser(models.RoleViewer))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `sensor_id="1"`)
+	assert.Equal(t, 3, storage.queries)
+}
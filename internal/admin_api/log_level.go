@@ -0,0 +1,38 @@
+package admin_api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sensord/internal/logging"
+	"sensord/internal/models"
+)
+
+// handleLogLevel GET returns the level of logs, PUT changes it at runtime e.g. to debug an issue without a restart
+func (s *AdminApiServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonBody, _ := json.Marshal(&models.LogLevelDto{Level: logging.Level.Level().String()})
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(jsonBody)
+	case http.MethodPut:
+		levelDto := &models.LogLevelDto{}
+		err := json.NewDecoder(r.Body).Decode(levelDto)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var level slog.Level
+		err = level.UnmarshalText([]byte(levelDto.Level))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		logging.Level.Set(level)
+		slog.WarnContext(r.Context(), "Log level changed", "by", adminUserFrom(r.Context()).Username, "level", level)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
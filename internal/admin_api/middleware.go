@@ -0,0 +1,193 @@
+package admin_api
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sensord/internal/logging"
+	"sensord/internal/metrics"
+	"strings"
+)
+
+// allowIpMiddleware rejects requests from clients outside the allowed networks
+func allowIpMiddleware(next http.Handler, allowCidrs, trustedProxies []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientAddr := clientIp(r, trustedProxies)
+		if !containsAddr(allowCidrs, clientAddr) {
+			slog.WarnContext(r.Context(), "Admin API access denied", "client", clientAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIp returns the IP of the client.
+// If the request came from a trusted proxy then the X-Forwarded-For is checked from the right to the left
+// and the first address that isn't a trusted proxy is the client.
+func clientIp(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+	clientAddr, err := netip.ParseAddr(remoteHost)
+	if err != nil {
+		return netip.Addr{}
+	}
+	clientAddr = clientAddr.Unmap()
+	if !containsAddr(trustedProxies, clientAddr) {
+		return clientAddr
+	}
+	// a proxy may append its own X-Forwarded-For header instead of extending the existing one
+	forwardedFor := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopAddr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// garbage in the header: don't trust anything to the left of it
+			return clientAddr
+		}
+		clientAddr = hopAddr.Unmap()
+		if !containsAddr(trustedProxies, clientAddr) {
+			return clientAddr
+		}
+	}
+	return clientAddr
+}
+
+func containsAddr(cidrs []netip.Prefix, addr netip.Addr) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// authMiddleware requires the Basic Auth and puts the authenticated user into the request context
+func authMiddleware(next http.Handler, users *adminUsers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			requestAuth(w)
+			return
+		}
+		user, err := users.authenticate(r.Context(), username, password)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Unable to authenticate", "username", username, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			requestAuth(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withAdminUser(r.Context(), user)))
+	})
+}
+
+func requestAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="sensord", charset="UTF-8"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// loadHtpasswd reads users from a htpasswd file. Only bcrypt hashes are supported e.g.
+//
+//	htpasswd -B -c admin.htpasswd yochbad
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open htpasswd")
+	}
+	defer f.Close()
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, passwordHash, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errors.Errorf("htpasswd line %d: expected user:hash", lineNum)
+		}
+		if _, err = bcrypt.Cost([]byte(passwordHash)); err != nil {
+			return nil, errors.Errorf("htpasswd line %d: only bcrypt hashes are supported", lineNum)
+		}
+		users[username] = []byte(passwordHash)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read htpasswd")
+	}
+	return users, nil
+}
+
+// requestIdMiddleware puts the caller's X-Request-Id or a new one into the request context so logs of the request
+// and of its DB queries can be correlated. The id is returned in the response.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if !logging.ValidRequestId([]byte(requestId)) {
+			requestId = logging.NewRequestId()
+		}
+		w.Header().Set("X-Request-Id", requestId)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestId(r.Context(), requestId)))
+	})
+}
+
+// statusRecorder remembers the response status for the metrics and the spans
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware counts requests by the route of the request and the response status.
+// The route is a registered pattern so unknown URLs don't add new series.
+func metricsMiddleware(next http.Handler, routeOf func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		metrics.CountRequest("admin", routeOf(r), recorder.status)
+	})
+}
+
+var tracer = otel.Tracer("sensord/internal/admin_api")
+
+// tracingMiddleware starts a span of the request named by its route.
+// If the request has the W3C traceparent header then the span continues the caller's trace.
+func tracingMiddleware(next http.Handler, routeOf func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeOf(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethod(r.Method), semconv.HTTPRoute(route)),
+		)
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package admin_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func Test_clientIp(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	newRequest := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total", nil)
+		r.RemoteAddr = remoteAddr
+		for _, xff := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", xff)
+		}
+		return r
+	}
+	// direct client can't spoof the X-Forwarded-For
+	assert.Equal(t, "203.0.113.1", clientIp(newRequest("203.0.113.1:1234", "192.168.1.1"), trustedProxies).String())
+	// behind the trusted proxy
+	assert.Equal(t, "192.168.1.1", clientIp(newRequest("10.0.0.1:1234", "192.168.1.1"), trustedProxies).String())
+	// the client added a fake hop but the proxy appended the real IP
+	assert.Equal(t, "203.0.113.1", clientIp(newRequest("10.0.0.1:1234", "192.168.1.1, 203.0.113.1"), trustedProxies).String())
+	// chain of trusted proxies and multiple headers
+	assert.Equal(t, "203.0.113.1", clientIp(newRequest("10.0.0.1:1234", "203.0.113.1", "10.0.0.2"), trustedProxies).String())
+	// IPv6
+	assert.Equal(t, "2001:db8::1", clientIp(newRequest("[2001:db8::1]:1234"), trustedProxies).String())
+}
+
+func Test_allowIpMiddleware(t *testing.T) {
+	allowCidrs := []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+	handler := allowIpMiddleware(okHandler, allowCidrs, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total", nil)
+	r.RemoteAddr = "192.168.1.10:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	r.RemoteAddr = "192.168.2.10:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_authMiddleware(t *testing.T) {
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswdPath := filepath.Join(t.TempDir(), "admin.htpasswd")
+	htpasswd := "# admins\nyochbad:" + string(passwordHash) + "\n"
+	assert.NoError(t, os.WriteFile(htpasswdPath, []byte(htpasswd), 0600))
+	users, err := loadHtpasswd(htpasswdPath)
+	assert.NoError(t, err)
+	handler := authMiddleware(okHandler, &adminUsers{htpasswd: users})
+
+	tests := []struct {
+		username, password string
+		expectedStatus     int
+	}{
+		{"yochbad", "secret", http.StatusOK},
+		{"yochbad", "wrong", http.StatusUnauthorized},
+		{"unknown", "secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total", nil)
+		r.SetBasicAuth(tt.username, tt.password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tt.expectedStatus, w.Code, tt.username+":"+tt.password)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+func Test_loadHtpasswd_OnlyBcrypt(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "admin.htpasswd")
+	assert.NoError(t, os.WriteFile(htpasswdPath, []byte("yochbad:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600))
+	_, err := loadHtpasswd(htpasswdPath)
+	assert.Error(t, err)
+}
+
+func Test_tracingMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeJson(r.Context(), []string{})
+		w.WriteHeader(http.StatusInternalServerError)
+	}), func(r *http.Request) string {
+		return "/api/v1/stats/Total"
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total?unit=celsius", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	encodeSpan, requestSpan := spans[0], spans[1]
+	assert.Equal(t, "encode_json", encodeSpan.Name())
+	assert.Equal(t, requestSpan.SpanContext().SpanID(), encodeSpan.Parent().SpanID())
+	assert.Equal(t, "GET /api/v1/stats/Total", requestSpan.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", requestSpan.SpanContext().TraceID().String())
+	assert.Equal(t, codes.Error, requestSpan.Status().Code)
+}
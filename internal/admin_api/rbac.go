@@ -0,0 +1,96 @@
+package admin_api
+
+import (
+	"context"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sensord/internal/db"
+	"sensord/internal/models"
+)
+
+// adminUsers authenticates users from the htpasswd file and from the DB
+type adminUsers struct {
+	// htpasswd users have the admin role. Useful to bootstrap DB users.
+	htpasswd map[string][]byte
+	// storage of users or nil if users are not stored in the DB
+	storage db.SensorsDb
+}
+
+// dummyHash is compared for unknown users so the response time doesn't reveal if the user exists
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// authenticate returns the user or nil if the credentials are invalid
+func (u *adminUsers) authenticate(ctx context.Context, username, password string) (*models.AdminUser, error) {
+	if passwordHash, found := u.htpasswd[username]; found {
+		if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+			return nil, nil
+		}
+		return &models.AdminUser{Username: username, Role: models.RoleAdmin}, nil
+	}
+	var user *models.AdminUser
+	if u.storage != nil {
+		var err error
+		user, err = u.storage.GetAdminUser(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if user == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+type adminUserCtxKey struct{}
+
+// anonymousUser is used when no authentication is configured
+func anonymousUser(role models.Role) *models.AdminUser {
+	return &models.AdminUser{Username: "anonymous", Role: role}
+}
+
+func withAdminUser(ctx context.Context, user *models.AdminUser) context.Context {
+	return context.WithValue(ctx, adminUserCtxKey{}, user)
+}
+
+// adminUserFrom returns the authenticated user of the request
+func adminUserFrom(ctx context.Context) *models.AdminUser {
+	user, _ := ctx.Value(adminUserCtxKey{}).(*models.AdminUser)
+	return user
+}
+
+// anonymousMiddleware gives everyone the role when no authentication is configured
+func anonymousMiddleware(next http.Handler, role models.Role) http.Handler {
+	user := anonymousUser(role)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withAdminUser(r.Context(), user)))
+	})
+}
+
+// requireRole allows the request only for users with the role or a higher one
+func requireRole(role models.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUserFrom(r.Context())
+		if user == nil || !user.Role.Allows(role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireUnscoped allows the request only for users not scoped to sensors.
+// Settings and the process-wide state aren't per sensor, so a scoped user would change or see all sensors.
+func requireUnscoped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := adminUserFrom(r.Context())
+		if user == nil || user.SensorIds != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,106 @@
+package admin_api
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"sensord/internal/db"
+	"sensord/internal/models"
+	"strings"
+	"testing"
+)
+
+// fakeUsersDb stores admin users in memory
+type fakeUsersDb struct {
+	db.SensorsDb
+	users map[string]*models.AdminUser
+}
+
+func (f *fakeUsersDb) GetAdminUser(ctx context.Context, username string) (*models.AdminUser, error) {
+	return f.users[username], nil
+}
+
+func Test_adminUsers_authenticate(t *testing.T) {
+	ctx := context.Background()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	viewer := &models.AdminUser{
+		Username:     "yochbad",
+		PasswordHash: string(passwordHash),
+		Role:         models.RoleViewer,
+		SensorIds:    []int{1},
+	}
+	users := &adminUsers{
+		htpasswd: map[string][]byte{"root": passwordHash},
+		storage:  &fakeUsersDb{users: map[string]*models.AdminUser{"yochbad": viewer}},
+	}
+
+	user, err := users.authenticate(ctx, "yochbad", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, viewer, user)
+
+	user, err = users.authenticate(ctx, "yochbad", "wrong")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+
+	// htpasswd users are admins
+	user, err = users.authenticate(ctx, "root", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, user.Role)
+	assert.Nil(t, user.SensorIds)
+
+	user, err = users.authenticate(ctx, "unknown", "secret")
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+}
+
+func Test_requireRole(t *testing.T) {
+	handler := requireRole(models.RoleOperator, okHandler)
+	tests := []struct {
+		user           *models.AdminUser
+		expectedStatus int
+	}{
+		{nil, http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleViewer}, http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleOperator}, http.StatusOK},
+		{&models.AdminUser{Role: models.RoleAdmin}, http.StatusOK},
+		{&models.AdminUser{Role: "unknown"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodDelete, "/api/v1/measurement?sensorId=1", nil)
+		if tt.user != nil {
+			r = r.WithContext(withAdminUser(r.Context(), tt.user))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tt.expectedStatus, w.Code)
+	}
+}
+
+func Test_requireUnscoped(t *testing.T) {
+	s := &AdminApiServer{}
+	mux := s.apiMux()
+	tests := []struct {
+		user           *models.AdminUser
+		method         string
+		target         string
+		expectedStatus int
+	}{
+		{&models.AdminUser{Role: models.RoleAdmin, SensorIds: []int{1}}, http.MethodPut, "/api/v1/log/level", http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleAdmin, SensorIds: []int{}}, http.MethodPut, "/api/v1/log/level", http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleAdmin, SensorIds: []int{1}}, http.MethodGet, "/api/v1/log/level", http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleAdmin}, http.MethodGet, "/api/v1/log/level", http.StatusOK},
+		{&models.AdminUser{Role: models.RoleViewer, SensorIds: []int{1}}, http.MethodGet, "/debug/vars", http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleViewer}, http.MethodGet, "/debug/vars", http.StatusOK},
+		{&models.AdminUser{Role: models.RoleViewer, SensorIds: []int{1}}, http.MethodGet, "/metrics", http.StatusForbidden},
+		{&models.AdminUser{Role: models.RoleViewer}, http.MethodGet, "/metrics", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(`{"Level":"debug"}`))
+		r = r.WithContext(withAdminUser(r.Context(), tt.user))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		assert.Equal(t, tt.expectedStatus, w.Code, tt.target)
+	}
+}
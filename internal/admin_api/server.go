@@ -2,10 +2,26 @@ package admin_api
 
 import (
 	"context"
+	"crypto/tls"
 	json "encoding/json"
-	"log"
+	"expvar"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/netutil"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"sensord/internal/certs"
+	"sensord/internal/core"
 	"sensord/internal/db"
+	"sensord/internal/health"
+	"sensord/internal/logging"
+	"sensord/internal/metrics"
+	"sensord/internal/models"
+	"sensord/internal/sensor_status"
+	"sensord/internal/units"
+	"strconv"
 	"time"
 )
 
@@ -13,29 +29,225 @@ import (
 type AdminApiServer struct {
 	storage    db.SensorsDb
 	listenAddr string
+	tlsCert    string
+	tlsKey     string
+	// tlsCerts the current certificate replaced by a reload or nil if TLS is disabled
+	tlsCerts *certs.Store
+	htpasswd string
+	dbUsers  bool
+	// anonymousRole of callers if the authentication is disabled
+	anonymousRole  models.Role
+	allowCidrs     []netip.Prefix
+	trustedProxies []netip.Prefix
+	registry       *sensor_status.Registry
+	health         *health.Health
+	// exporter of sensors values or nil if it's disabled
+	exporter *sensorExporter
+	// reloader of the config or nil if the reload endpoint is disabled
+	reloader *core.Reloader
+	// limits of the server against slow and hostile clients
+	maxBodySize       int
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxConns          int
+	httpServer        *http.Server
 }
 
-func NewAdminApiServer(ListenAddr string, storage db.SensorsDb) *AdminApiServer {
-	return &AdminApiServer{
-		listenAddr: ListenAddr,
-		storage:    storage,
+func NewAdminApiServer(conf *core.SensordConf, storage db.SensorsDb, registry *sensor_status.Registry, health *health.Health, reloader *core.Reloader) *AdminApiServer {
+	s := &AdminApiServer{
+		listenAddr:        conf.AdminApiListenHttp,
+		storage:           storage,
+		tlsCert:           conf.AdminTlsCert,
+		tlsKey:            conf.AdminTlsKey,
+		htpasswd:          conf.AdminHtpasswd,
+		dbUsers:           conf.AdminDbUsers,
+		anonymousRole:     conf.AdminAnonymousRole,
+		allowCidrs:        conf.AdminAllowCidrs,
+		trustedProxies:    conf.AdminTrustedProxies,
+		registry:          registry,
+		health:            health,
+		reloader:          reloader,
+		maxBodySize:       conf.AdminMaxBodySize,
+		readHeaderTimeout: conf.AdminReadHeaderTimeout,
+		readTimeout:       conf.AdminReadTimeout,
+		writeTimeout:      conf.AdminWriteTimeout,
+		idleTimeout:       conf.AdminIdleTimeout,
+		maxConns:          conf.AdminMaxConns,
 	}
+	if conf.AdminTlsCert != "" {
+		s.tlsCerts = &certs.Store{}
+	}
+	if conf.ExporterEnabled {
+		s.exporter = newSensorExporter(storage, registry, conf.ExporterMaxSensors, conf.ExporterCacheTtl)
+	}
+	s.httpServer = s.newHttpServer(s.handler())
+	return s
 }
 
 func (s *AdminApiServer) Start() {
-	log.Printf("NOTICE: Start sensord Admin API server on %s\n", s.listenAddr)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/stats/Total", s.handleGetStatsTotal)
-	mux.HandleFunc("/api/v1/stats/EachSensor", s.handleGetStatsForEachSensor)
-	mux.HandleFunc("/api/v1/stats/EachSensorAndDay", s.handleGetStatsForEachSensorAndDay)
-	apiServerHttp := &http.Server{
-		Addr:    s.listenAddr,
-		Handler: mux,
-	}
-	err := apiServerHttp.ListenAndServe()
+	slog.Info("Start sensord Admin API server", "addr", s.listenAddr)
+	listener, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		logging.Fatal("Admin API server listen error", "err", err)
+	}
+	// extra connections wait in the backlog
+	listener = netutil.LimitListener(listener, s.maxConns)
+	if s.tlsCerts != nil {
+		tlsConfig, tlsErr := certs.Load(s.tlsCert, s.tlsKey, "")
+		if tlsErr != nil {
+			logging.Fatal("Admin API server TLS error", "err", tlsErr)
+		}
+		s.tlsCerts.Set(tlsConfig)
+		// the certificate is taken from the store so a reload replaces it
+		s.httpServer.TLSConfig = s.tlsCerts.ServerConfig()
+		err = s.httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = s.httpServer.Serve(listener)
+	}
 	if err != nil && err != http.ErrServerClosed {
-		log.Fatalf("CRIT: Admin API server http shutdown error: %s\n", err)
+		logging.Fatal("Admin API server http shutdown error", "err", err)
+	}
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until the ctx is done
+func (s *AdminApiServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// newHttpServer with limits so slow or hostile clients can't exhaust connections and memory
+func (s *AdminApiServer) newHttpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           http.MaxBytesHandler(handler, int64(s.maxBodySize)),
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+}
+
+// handler routes requests through the auth middlewares.
+// Probes of an orchestrator don't have credentials so they bypass the auth and the IP allowlist.
+func (s *AdminApiServer) handler() http.Handler {
+	mux := s.apiMux()
+	probes := http.NewServeMux()
+	probes.HandleFunc("/healthz", s.handleHealthz)
+	probes.HandleFunc("/readyz", s.handleReadyz)
+	muxRouteOf := func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			return metrics.HandlerOther
+		}
+		return pattern
+	}
+	// probes aren't traced so they don't flood the traces
+	probes.Handle("/", tracingMiddleware(s.protect(mux), muxRouteOf))
+	routeOf := func(r *http.Request) string {
+		_, pattern := probes.Handler(r)
+		if pattern == "/" {
+			return muxRouteOf(r)
+		}
+		if pattern == "" {
+			return metrics.HandlerOther
+		}
+		return pattern
+	}
+	return requestIdMiddleware(metricsMiddleware(probes, routeOf))
+}
+
+// apiMux routes the API requests and checks the user's role
+func (s *AdminApiServer) apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/stats/Total", requireRole(models.RoleViewer, s.handleGetStatsTotal))
+	mux.HandleFunc("/api/v1/stats/EachSensor", requireRole(models.RoleViewer, s.handleGetStatsForEachSensor))
+	mux.HandleFunc("/api/v1/stats/EachSensorAndDay", requireRole(models.RoleViewer, s.handleGetStatsForEachSensorAndDay))
+	mux.HandleFunc("/api/v1/sensors/status", requireRole(models.RoleViewer, s.handleGetSensorsStatus))
+	// operators maintain sensors e.g. clear the data of a replaced or miscalibrated sensor.
+	// The handler checks that the sensor is in the user's scope.
+	mux.HandleFunc("/api/v1/measurement", requireRole(models.RoleOperator, s.handleDeleteMeasurements))
+	mux.HandleFunc("/api/v1/users", requireRole(models.RoleAdmin, s.handleUsers))
+	// settings of the whole server
+	mux.HandleFunc("/api/v1/log/level", requireRole(models.RoleAdmin, requireUnscoped(s.handleLogLevel)))
+	if s.reloader != nil {
+		mux.HandleFunc("/api/v1/config/reload", requireRole(models.RoleAdmin, requireUnscoped(s.handleConfigReload)))
+	}
+	// runtime and rate limiter metrics
+	mux.HandleFunc("/debug/vars", requireRole(models.RoleViewer, requireUnscoped(handleVars)))
+	// Prometheus metrics of the sensord itself
+	mux.HandleFunc("/metrics", requireRole(models.RoleViewer, requireUnscoped(metrics.Handler().ServeHTTP)))
+	if s.exporter != nil {
+		// sensors values for Grafana. A user sees only own sensors
+		mux.HandleFunc("/metrics/sensors", requireRole(models.RoleViewer, s.exporter.handleSensorMetrics))
+	}
+	return mux
+}
+
+// protect the API with the auth middlewares
+func (s *AdminApiServer) protect(mux *http.ServeMux) http.Handler {
+	var handler http.Handler = mux
+	if s.htpasswd != "" || s.dbUsers {
+		users := &adminUsers{}
+		if s.htpasswd != "" {
+			var err error
+			users.htpasswd, err = loadHtpasswd(s.htpasswd)
+			if err != nil {
+				logging.Fatal("Admin API server users error", "err", err)
+			}
+		}
+		if s.dbUsers {
+			users.storage = s.storage
+		}
+		handler = authMiddleware(handler, users)
+	} else {
+		slog.Warn("Admin API authentication is disabled", "role", s.anonymousRole)
+		handler = anonymousMiddleware(handler, s.anonymousRole)
+	}
+	// check IP first to not waste CPU on bcrypt for unknown clients
+	if len(s.allowCidrs) > 0 {
+		handler = allowIpMiddleware(handler, s.allowCidrs, s.trustedProxies)
 	}
+	return handler
+}
+
+// handleHealthz the process is alive
+func (s *AdminApiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// handleReadyz the sensord can serve: the DB is reachable, the schema is migrated, the ingestion isn't saturated
+// and it's not shutting down. Returns 503 with statuses of components otherwise.
+func (s *AdminApiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	readiness := s.health.Readiness(r.Context())
+	// the probe is served without auth so the details are only logged
+	for _, component := range readiness.Components {
+		if !component.Ready {
+			slog.WarnContext(r.Context(), "Component is not ready", "component", component.Name, "err", component.Error)
+		}
+	}
+	jsonBody, _ := json.Marshal(readiness)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if readiness.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(jsonBody)
 }
 
 func (s *AdminApiServer) handleGetStatsTotal(w http.ResponseWriter, r *http.Request) {
@@ -43,7 +255,7 @@ func (s *AdminApiServer) handleGetStatsTotal(w http.ResponseWriter, r *http.Requ
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			log.Printf("ERR: Unexpected error %s\n", panicErr)
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}()
@@ -52,14 +264,21 @@ func (s *AdminApiServer) handleGetStatsTotal(w http.ResponseWriter, r *http.Requ
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	ctx := context.Background()
+	ctx := r.Context()
+	filter, err := statsFilterFor(r, adminUserFrom(ctx))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	endTime, startTime := weekAgo()
-	stats, err := s.storage.GetMeasurementPeriodStatsTotal(ctx, startTime, endTime)
+	stats, err := s.storage.GetMeasurementPeriodStatsTotal(ctx, startTime, endTime, filter)
 	if err != nil {
+		slog.ErrorContext(ctx, "Unable to get stats", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	jsonBody, _ := json.Marshal(stats)
+	convertStats(stats, r.URL.Query().Get("unit"))
+	jsonBody := encodeJson(ctx, stats)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -72,7 +291,7 @@ func (s *AdminApiServer) handleGetStatsForEachSensor(w http.ResponseWriter, r *h
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			log.Printf("ERR: Unexpected error %s\n", panicErr)
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}()
@@ -81,14 +300,21 @@ func (s *AdminApiServer) handleGetStatsForEachSensor(w http.ResponseWriter, r *h
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	ctx := context.Background()
+	ctx := r.Context()
+	filter, err := statsFilterFor(r, adminUserFrom(ctx))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	endTime, startTime := weekAgo()
-	stats, err := s.storage.GetMeasurementPeriodStatsForEachSensor(ctx, startTime, endTime)
+	stats, err := s.storage.GetMeasurementPeriodStatsForEachSensor(ctx, startTime, endTime, filter)
 	if err != nil {
+		slog.ErrorContext(ctx, "Unable to get stats", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	jsonBody, _ := json.Marshal(stats)
+	convertStats(stats, r.URL.Query().Get("unit"))
+	jsonBody := encodeJson(ctx, stats)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -101,7 +327,7 @@ func (s *AdminApiServer) handleGetStatsForEachSensorAndDay(w http.ResponseWriter
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			log.Printf("ERR: Unexpected error %s\n", panicErr)
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}()
@@ -110,14 +336,21 @@ func (s *AdminApiServer) handleGetStatsForEachSensorAndDay(w http.ResponseWriter
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	ctx := context.Background()
+	ctx := r.Context()
+	filter, err := statsFilterFor(r, adminUserFrom(ctx))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	endTime, startTime := weekAgo()
-	stats, err := s.storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, startTime, endTime)
+	stats, err := s.storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, startTime, endTime, filter)
 	if err != nil {
+		slog.ErrorContext(ctx, "Unable to get stats", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	jsonBody, _ := json.Marshal(stats)
+	convertStats(stats, r.URL.Query().Get("unit"))
+	jsonBody := encodeJson(ctx, stats)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -125,8 +358,149 @@ func (s *AdminApiServer) handleGetStatsForEachSensorAndDay(w http.ResponseWriter
 	return
 }
 
+// handleGetSensorsStatus returns status of all the user's sensors or of one with ?sensorId=1
+func (s *AdminApiServer) handleGetSensorsStatus(w http.ResponseWriter, r *http.Request) {
+	// catch panic
+	defer func() {
+		panicErr := recover()
+		if panicErr != nil {
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user := adminUserFrom(r.Context())
+	var jsonBody []byte
+	if sensorIdStr := r.URL.Query().Get("sensorId"); sensorIdStr != "" {
+		sensorId, err := strconv.Atoi(sensorIdStr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := s.registry.Get(sensorId)
+		if status == nil || !user.CanSeeSensor(sensorId) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		jsonBody = encodeJson(r.Context(), status)
+	} else {
+		statuses := []*models.SensorStatus{}
+		for _, status := range s.registry.List() {
+			if user.CanSeeSensor(status.SensorId) {
+				statuses = append(statuses, status)
+			}
+		}
+		jsonBody = encodeJson(r.Context(), statuses)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonBody)
+}
+
+// handleDeleteMeasurements removes all measurements of a sensor e.g. DELETE /api/v1/measurement?sensorId=1
+func (s *AdminApiServer) handleDeleteMeasurements(w http.ResponseWriter, r *http.Request) {
+	// catch panic
+	defer func() {
+		panicErr := recover()
+		if panicErr != nil {
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sensorId, err := strconv.Atoi(r.URL.Query().Get("sensorId"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	user := adminUserFrom(ctx)
+	if !user.CanSeeSensor(sensorId) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	deleted, err := s.storage.DeleteMeasurements(ctx, sensorId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to delete measurements", "sensor_id", sensorId, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "Measurements deleted", "by", user.Username, "sensor_id", sensorId, "days", deleted)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// encodeJson the response body in a span so a slow report shows how long the encoding took
+func encodeJson(ctx context.Context, v any) []byte {
+	_, span := tracer.Start(ctx, "encode_json")
+	defer span.End()
+	jsonBody, _ := json.Marshal(v)
+	return jsonBody
+}
+
+// convertStats sets the metric's unit to the stats and converts them to the output unit e.g. ?unit=fahrenheit.
+// Stats of metrics that can't be converted to the unit are left in their own unit.
+func convertStats(stats []*models.MeasurementRec, unit string) {
+	for _, rec := range stats {
+		rec.Unit = models.MetricUnits[rec.Metric]
+		if unit == "" || unit == rec.Unit {
+			continue
+		}
+		conversion, found := units.Find(rec.Unit, unit)
+		if !found {
+			continue
+		}
+		conversion.ConvertStats(rec)
+		rec.Unit = unit
+	}
+}
+
+// statsFilterFor parses the report query parameters e.g. ?metric=temperature&unit=fahrenheit and limits the report to the user's sensors
+func statsFilterFor(r *http.Request, user *models.AdminUser) (*models.StatsFilter, error) {
+	metric := r.URL.Query().Get("metric")
+	if metric != "" {
+		if _, found := models.MetricUnits[metric]; !found {
+			return nil, errors.Errorf("unknown metric %q", metric)
+		}
+	}
+	unit := r.URL.Query().Get("unit")
+	if unit != "" && !units.IsKnown(unit) {
+		return nil, errors.Errorf("unknown unit %q", unit)
+	}
+	return &models.StatsFilter{
+		SensorIds: user.SensorIds,
+		Metric:    metric,
+	}, nil
+}
+
 func weekAgo() (time.Time, time.Time) {
 	endTime := time.Now().Truncate(24 * time.Hour)
 	startTime := endTime.AddDate(0, 0, -7)
 	return endTime, startTime
 }
+
+// handleVars serves the expvar vars like the expvar.Handler but without the `cmdline` that may contain secrets
+func handleVars(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			_, _ = fmt.Fprint(w, ",\n")
+		}
+		first = false
+		_, _ = fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	_, _ = fmt.Fprint(w, "\n}\n")
+}
@@ -0,0 +1,333 @@
+package admin_api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sensord/internal/certs"
+	"sensord/internal/core"
+	"sensord/internal/health"
+	"sensord/internal/logging"
+	"sensord/internal/metrics"
+	"sensord/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves the handler with the limits of the server on a random port
+func startTestServer(t *testing.T, s *AdminApiServer, handler http.Handler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := s.newHttpServer(handler)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return listener.Addr().String()
+}
+
+func newLimitedServer() *AdminApiServer {
+	return &AdminApiServer{
+		maxBodySize:       100,
+		readHeaderTimeout: 200 * time.Millisecond,
+		readTimeout:       300 * time.Millisecond,
+		writeTimeout:      300 * time.Millisecond,
+		idleTimeout:       200 * time.Millisecond,
+	}
+}
+
+// waitClosed returns true if the server closed the connection before the deadline
+func waitClosed(conn net.Conn, deadline time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(deadline))
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err != nil {
+			netErr, isNetErr := err.(net.Error)
+			return !isNetErr || !netErr.Timeout()
+		}
+	}
+}
+
+func Test_newHttpServer_SlowHeaders(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer(), okHandler)
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// slowloris: send a header line from time to time and never finish the request
+	_, err = conn.Write([]byte("GET /api/v1/stats/Total HTTP/1.1\r\nHost: sensord\r\n"))
+	assert.NoError(t, err)
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := conn.Write([]byte("X-Slow: 1\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	assert.True(t, waitClosed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_newHttpServer_IdleConnection(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer(), okHandler)
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	assert.True(t, waitClosed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_newHttpServer_BodyTooLarge(t *testing.T) {
+	readBody := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	addr := startTestServer(t, newLimitedServer(), readBody)
+
+	resp, err := http.Post("http://"+addr+"/api/v1/users", "application/json", strings.NewReader(strings.Repeat("a", 100)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post("http://"+addr+"/api/v1/users", "application/json", strings.NewReader(strings.Repeat("a", 101)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func Test_AdminApiServer_handler_Probes(t *testing.T) {
+	h := health.NewHealth()
+	s := &AdminApiServer{
+		allowCidrs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		health:     h,
+	}
+	handler := s.handler()
+
+	// probes bypass the IP allowlist and the auth
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"ready":true,"draining":false,"components":[]}`, w.Body.String())
+
+	h.AddCheck("db", func(ctx context.Context) error {
+		return errors.New("failed to connect to `host=db user=postgres database=sensorsdb`: connection refused")
+	})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	// the error may reveal the DB host and user
+	assert.JSONEq(t, `{"ready":false,"draining":false,"components":[{"name":"db","ready":false}]}`, w.Body.String())
+
+	// the API is still protected
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats/Total", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func Test_AdminApiServer_handler_Metrics(t *testing.T) {
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleViewer}
+	handler := s.handler()
+	ok := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("admin", "/metrics", "200"))
+	notFound := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("admin", metrics.HandlerOther, "404"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "sensord_http_requests_total")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Equal(t, ok+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("admin", "/metrics", "200")))
+	assert.Equal(t, notFound+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("admin", metrics.HandlerOther, "404")))
+}
+
+func Test_AdminApiServer_handler_AnonymousViewer(t *testing.T) {
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleViewer}
+	handler := s.handler()
+	level := logging.Level.Level()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// without the authentication nobody can change settings by default
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/v1/log/level", strings.NewReader(`{"Level":"debug"}`)))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, level, logging.Level.Level())
+}
+
+func Test_AdminApiServer_handler_Vars(t *testing.T) {
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleViewer}
+	handler := s.handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var vars map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.Contains(t, vars, "memstats")
+	assert.NotContains(t, vars, "cmdline")
+}
+
+func Test_AdminApiServer_handler_LogLevel(t *testing.T) {
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleAdmin}
+	handler := s.handler()
+	defer logging.Level.Set(logging.Level.Level())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/v1/log/level", strings.NewReader(`{"Level":"debug"}`)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, slog.LevelDebug, logging.Level.Level())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/log/level", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Level":"DEBUG"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/v1/log/level", strings.NewReader(`{"Level":"verbose"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, slog.LevelDebug, logging.Level.Level())
+}
+
+func Test_AdminApiServer_handler_RequestId(t *testing.T) {
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleViewer}
+	handler := s.handler()
+
+	r := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	r.Header.Set("X-Request-Id", "f47ac10b-58cc-4372-a567-0e02b2c3d479")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", w.Header().Get("X-Request-Id"))
+
+	// a new id instead of an invalid one
+	r.Header.Set("X-Request-Id", strings.Repeat("a", 100))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.NotEmpty(t, w.Header().Get("X-Request-Id"))
+	assert.NotEqual(t, strings.Repeat("a", 100), w.Header().Get("X-Request-Id"))
+}
+
+func Test_AdminApiServer_handler_ConfigReload(t *testing.T) {
+	var loadErr error
+	reloader := core.NewReloader(&core.SensordConf{SensorRateLimit: 1}, func() (*core.SensordConf, error) {
+		return &core.SensordConf{SensorRateLimit: 5, AdminApiListenHttp: ":9091"}, loadErr
+	})
+	s := &AdminApiServer{health: health.NewHealth(), anonymousRole: models.RoleAdmin, reloader: reloader}
+	reloader.Add(s)
+	handler := s.handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config/reload", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Applied":["SENSOR_RATE_LIMIT"],"RestartRequired":["ADMIN_LISTEN_HTTP"]}`, w.Body.String())
+
+	loadErr = errors.New("SENSOR_RATE_LIMIT must not be negative")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/config/reload", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.JSONEq(t, `{"Applied":null,"RestartRequired":null,"Error":"SENSOR_RATE_LIMIT must not be negative"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/config/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// an admin scoped to sensors can't reload the whole config
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/config/reload", nil)
+	r = r.WithContext(withAdminUser(r.Context(), &models.AdminUser{Role: models.RoleAdmin, SensorIds: []int{1}}))
+	w = httptest.NewRecorder()
+	s.apiMux().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// writeSelfSigned writes a certificate with the serial number and its key to the same files on each call
+func writeSelfSigned(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "sensord"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile := filepath.Join(dir, "admin.pem")
+	keyFile := filepath.Join(dir, "admin.key")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+func Test_AdminApiServer_Reload_CertRotatedInPlace(t *testing.T) {
+	certFile, keyFile := writeSelfSigned(t, t.TempDir(), 1)
+	conf := &core.SensordConf{AdminTlsCert: certFile, AdminTlsKey: keyFile}
+	reloader := core.NewReloader(conf, func() (*core.SensordConf, error) {
+		// the config file isn't changed
+		return &core.SensordConf{AdminTlsCert: certFile, AdminTlsKey: keyFile}, nil
+	})
+	s := &AdminApiServer{health: health.NewHealth(), tlsCerts: &certs.Store{}}
+	tlsConfig, err := certs.Load(certFile, keyFile, "")
+	assert.NoError(t, err)
+	s.tlsCerts.Set(tlsConfig)
+	reloader.Add(s)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.tlsCerts.ServerConfig())
+	assert.NoError(t, err)
+	server := &http.Server{Handler: s.handler()}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+	serialOf := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		assert.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), serialOf())
+
+	// e.g. a cert-manager renews the certificate at the same path
+	writeSelfSigned(t, filepath.Dir(certFile), 2)
+	changes, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Applied)
+	assert.Equal(t, int64(2), serialOf())
+}
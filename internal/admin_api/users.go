@@ -0,0 +1,138 @@
+package admin_api
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"sensord/internal/models"
+)
+
+// handleUsers manages admin users stored in the DB:
+// GET lists users, PUT creates or updates a user from a JSON body, DELETE ?username= removes a user.
+// An admin scoped to sensors manages only users scoped to the same sensors or fewer.
+func (s *AdminApiServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	// catch panic
+	defer func() {
+		panicErr := recover()
+		if panicErr != nil {
+			slog.ErrorContext(r.Context(), "Unexpected error", "err", panicErr)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if !s.dbUsers {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.listUsers(w, r)
+	case http.MethodPut:
+		s.storeUser(w, r)
+	case http.MethodDelete:
+		s.deleteUser(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *AdminApiServer) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.storage.ListAdminUsers(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to list users", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	caller := adminUserFrom(r.Context())
+	visible := make([]*models.AdminUser, 0, len(users))
+	for _, user := range users {
+		if caller.CanSeeSensors(user.SensorIds) {
+			visible = append(visible, user)
+		}
+	}
+	jsonBody, _ := json.Marshal(visible)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonBody)
+}
+
+func (s *AdminApiServer) storeUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userDto := &models.AdminUserDto{}
+	err := json.NewDecoder(r.Body).Decode(userDto)
+	if err != nil || userDto.Username == "" || !userDto.Role.IsValid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	caller := adminUserFrom(ctx)
+	// a scoped admin can't grant access to other sensors
+	if !caller.CanSeeSensors(userDto.SensorIds) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	existing, err := s.storage.GetAdminUser(ctx, userDto.Username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// nor take over a user with access to other sensors
+	if existing != nil && !caller.CanSeeSensors(existing.SensorIds) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user := &models.AdminUser{
+		Username:  userDto.Username,
+		Role:      userDto.Role,
+		SensorIds: userDto.SensorIds,
+	}
+	if userDto.Password != "" {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(userDto.Password), bcrypt.DefaultCost)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user.PasswordHash = string(passwordHash)
+	} else if existing != nil {
+		user.PasswordHash = existing.PasswordHash
+	} else {
+		// a new user must have a password
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = s.storage.StoreAdminUser(ctx, user)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to store user", "username", user.Username, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, "User stored", "by", caller.Username, "username", user.Username, "role", user.Role)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminApiServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	username := r.URL.Query().Get("username")
+	existing, err := s.storage.GetAdminUser(ctx, username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if existing != nil && !adminUserFrom(ctx).CanSeeSensors(existing.SensorIds) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	deleted, err := s.storage.DeleteAdminUser(ctx, username)
+	if err != nil {
+		slog.ErrorContext(ctx, "Unable to delete user", "username", username, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(ctx, "User deleted", "by", adminUserFrom(ctx).Username, "username", username)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package admin_api
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sensord/internal/models"
+	"strings"
+	"testing"
+)
+
+func (f *fakeUsersDb) ListAdminUsers(ctx context.Context) ([]*models.AdminUser, error) {
+	users := make([]*models.AdminUser, 0, len(f.users))
+	for _, user := range f.users {
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (f *fakeUsersDb) StoreAdminUser(ctx context.Context, user *models.AdminUser) error {
+	f.users[user.Username] = user
+	return nil
+}
+
+func (f *fakeUsersDb) DeleteAdminUser(ctx context.Context, username string) (bool, error) {
+	_, found := f.users[username]
+	delete(f.users, username)
+	return found, nil
+}
+
+func Test_AdminApiServer_handleUsers_Scope(t *testing.T) {
+	storage := &fakeUsersDb{users: map[string]*models.AdminUser{
+		"root":    {Username: "root", PasswordHash: "hash", Role: models.RoleAdmin},
+		"yochbad": {Username: "yochbad", PasswordHash: "hash", Role: models.RoleViewer, SensorIds: []int{1}},
+	}}
+	s := &AdminApiServer{storage: storage, dbUsers: true}
+	scopedAdmin := &models.AdminUser{Username: "lead", Role: models.RoleAdmin, SensorIds: []int{1, 2}}
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r = r.WithContext(withAdminUser(r.Context(), scopedAdmin))
+		w := httptest.NewRecorder()
+		s.handleUsers(w, r)
+		return w
+	}
+
+	// the scoped admin can't create an unscoped user or give access to other sensors
+	w := call(http.MethodPut, "/api/v1/users", `{"Username":"mallory","Password":"s3cr3t","Role":"admin"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = call(http.MethodPut, "/api/v1/users", `{"Username":"mallory","Password":"s3cr3t","Role":"viewer","SensorIds":[2,3]}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, storage.users, "mallory")
+
+	// nor take over or delete a user with a wider scope
+	w = call(http.MethodPut, "/api/v1/users", `{"Username":"root","Password":"s3cr3t","Role":"admin","SensorIds":[1]}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "hash", storage.users["root"].PasswordHash)
+	w = call(http.MethodDelete, "/api/v1/users?username=root", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, storage.users, "root")
+
+	// users within the scope are managed as usual
+	w = call(http.MethodPut, "/api/v1/users", `{"Username":"yochbad","Role":"operator","SensorIds":[1,2]}`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, models.RoleOperator, storage.users["yochbad"].Role)
+	assert.Equal(t, "hash", storage.users["yochbad"].PasswordHash)
+
+	w = call(http.MethodGet, "/api/v1/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"Username":"yochbad","Role":"operator","SensorIds":[1,2]}]`, w.Body.String())
+
+	w = call(http.MethodDelete, "/api/v1/users?username=yochbad", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.NotContains(t, storage.users, "yochbad")
+}
@@ -0,0 +1,60 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"os"
+	"sync/atomic"
+)
+
+// Store holds the current TLS certificate and client CAs of a server.
+// A reload replaces them for new handshakes while open connections keep going.
+type Store struct {
+	config atomic.Pointer[tls.Config]
+}
+
+// Set the config of new handshakes
+func (s *Store) Set(config *tls.Config) {
+	s.config.Store(config)
+}
+
+// ServerConfig for the listener. Each handshake gets the current config of the store.
+func (s *Store) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.config.Load(), nil
+		},
+		// servers check that a certificate is configured
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &s.config.Load().Certificates[0], nil
+		},
+	}
+}
+
+// Load the certificate with its key and if the clientCaFile is set then require a client certificate signed by the CA (mTLS)
+func Load(certFile, keyFile, clientCaFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load the TLS certificate")
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCaFile == "" {
+		return tlsConfig, nil
+	}
+	caPem, err := os.ReadFile(clientCaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read client CA")
+	}
+	clientCas := x509.NewCertPool()
+	if !clientCas.AppendCertsFromPEM(caPem) {
+		return nil, errors.Errorf("No certificates found in client CA %s", clientCaFile)
+	}
+	tlsConfig.ClientCAs = clientCas
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
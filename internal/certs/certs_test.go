@@ -0,0 +1,94 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a certificate with the serial number and its key to the dir
+func writeSelfSigned(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "sensord"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+// serialOf the certificate that the server presents
+func serialOf(t *testing.T, addr string) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func Test_Store_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir, 1)
+	tlsConfig, err := Load(certFile, keyFile, "")
+	assert.NoError(t, err)
+	store := &Store{}
+	store.Set(tlsConfig)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", store.ServerConfig())
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}(conn)
+		}
+	}()
+	assert.Equal(t, int64(1), serialOf(t, listener.Addr().String()))
+
+	// a renewed certificate is served to new connections
+	certFile, keyFile = writeSelfSigned(t, dir, 2)
+	tlsConfig, err = Load(certFile, keyFile, "")
+	assert.NoError(t, err)
+	store.Set(tlsConfig)
+	assert.Equal(t, int64(2), serialOf(t, listener.Addr().String()))
+}
+
+func Test_Load_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Load(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing.key"), "")
+	assert.ErrorContains(t, err, "Unable to load the TLS certificate")
+
+	certFile, keyFile := writeSelfSigned(t, dir, 1)
+	_, err = Load(certFile, keyFile, keyFile)
+	assert.ErrorContains(t, err, "No certificates found in client CA")
+
+	tlsConfig, err := Load(certFile, keyFile, certFile)
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+}
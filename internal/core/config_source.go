@@ -0,0 +1,366 @@
+package core
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"sensord/internal/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted replaces secrets in the printed config
+const redacted = "REDACTED"
+
+// setting of a SensordConf field
+type setting struct {
+	// name of the env e.g. SENSOR_LISTEN_HTTP
+	name   string
+	secret bool
+	// reload the setting is applied without a restart
+	reload bool
+	isBool bool
+	field  int
+}
+
+// settings of all SensordConf fields in their order
+var settings = settingsOf(reflect.TypeOf(SensordConf{}))
+
+func settingsOf(confType reflect.Type) []setting {
+	var list []setting
+	for i := 0; i < confType.NumField(); i++ {
+		field := confType.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		s := setting{
+			name:   name,
+			isBool: field.Type.Kind() == reflect.Bool,
+			field:  i,
+		}
+		for _, option := range strings.Split(options, ",") {
+			switch option {
+			case "secret":
+				s.secret = true
+			case "reload":
+				s.reload = true
+			}
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// fileKey of the setting in the config file e.g. sensor_listen_http
+func fileKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// flagName of the setting e.g. --sensor-listen-http
+func flagName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// configSource layers of raw settings. A flag overrides an env and a non-empty env overrides the config file.
+// A setting that is empty in all the layers gets its default value.
+type configSource struct {
+	file  map[string]string
+	flags map[string]string
+}
+
+// newConfigSource parses the command-line flags and reads the config file of the `--config` flag or the SENSORD_CONFIG env
+func newConfigSource(args []string) (*configSource, error) {
+	src := &configSource{
+		file:  map[string]string{},
+		flags: map[string]string{},
+	}
+	flags := flag.NewFlagSet("sensord", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("SENSORD_CONFIG"), "path to a YAML config file. Env: SENSORD_CONFIG")
+	for _, s := range settings {
+		// a flag is visible to other users of the host e.g. in the `ps` so secrets are taken only from the env or the file
+		if s.secret {
+			continue
+		}
+		name := s.name
+		set := func(val string) error {
+			src.flags[name] = val
+			return nil
+		}
+		if s.isBool {
+			flags.BoolFunc(flagName(name), "overrides the "+name, set)
+		} else {
+			flags.Func(flagName(name), "overrides the "+name, set)
+		}
+	}
+	// the flag.ErrHelp is returned as is so the caller can exit without an error
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, errors.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if *configFile != "" {
+		src.file, err = readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// readConfigFile reads a YAML map of settings. Unknown keys are rejected so a typo doesn't silently keep a default.
+// A list value is joined by a comma e.g. a list of CIDRs.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read the config file")
+	}
+	var raw map[string]any
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	known := map[string]string{}
+	for _, s := range settings {
+		known[fileKey(s.name)] = s.name
+	}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := map[string]string{}
+	for _, key := range keys {
+		name, found := known[key]
+		if !found {
+			return nil, errors.Errorf("%s: unknown setting %q", path, key)
+		}
+		val, err := fileValue(raw[key])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: %s", path, key)
+		}
+		values[name] = val
+	}
+	return values, nil
+}
+
+// fileValue of a YAML scalar or a list of scalars
+func fileValue(val any) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case []any, map[string]any, map[any]any:
+				return "", errors.New("expected a list of scalars")
+			}
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any, map[any]any:
+		return "", errors.New("expected a scalar or a list")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// get the raw value of the setting or empty if it's not set
+func (s *configSource) get(name string) string {
+	if val, found := s.flags[name]; found {
+		return val
+	}
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return s.file[name]
+}
+
+// getDuration parses a duration like `30s` or returns the default value if the setting is empty
+func (s *configSource) getDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	val := s.get(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.Wrap(err, name)
+	}
+	return duration, nil
+}
+
+// getInt parses an integer or returns the default value if the setting is empty
+func (s *configSource) getInt(name string, defaultValue int) (int, error) {
+	val := s.get(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+	num, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.Wrap(err, name)
+	}
+	return num, nil
+}
+
+// getFloat parses a float or returns the default value if the setting is empty
+func (s *configSource) getFloat(name string, defaultValue float64) (float64, error) {
+	val := s.get(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+	num, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, name)
+	}
+	return num, nil
+}
+
+// getBool parses `true` or `false`. An empty setting is false.
+func (s *configSource) getBool(name string) (bool, error) {
+	val := s.get(name)
+	if val == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrap(err, name)
+	}
+	return b, nil
+}
+
+// WriteYaml writes the effective config in the format of the config file with secrets redacted
+func (conf *SensordConf) WriteYaml(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	confValue := reflect.ValueOf(conf).Elem()
+	for _, s := range settings {
+		val := confValue.Field(s.field).Interface()
+		if s.secret {
+			val = redact(val)
+		}
+		valNode := &yaml.Node{}
+		err := valNode.Encode(formatSetting(val))
+		if err != nil {
+			return errors.Wrap(err, s.name)
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: fileKey(s.name)}, valNode)
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(doc)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// redact secrets of sensors or a password of a DB URL
+func redact(val any) any {
+	switch v := val.(type) {
+	case map[int]string:
+		secrets := map[int]string{}
+		for sensorId := range v {
+			secrets[sensorId] = redacted
+		}
+		return secrets
+	case string:
+		if v == "" {
+			return v
+		}
+		u, err := url.Parse(v)
+		// a key=value DSN or a password in the query can't be redacted partially
+		if err != nil || u.Scheme == "" || u.Query().Has("password") {
+			return redacted
+		}
+		return u.Redacted()
+	default:
+		return redacted
+	}
+}
+
+// formatSetting in the same format as it's parsed. Numbers and booleans are kept as is.
+func formatSetting(val any) any {
+	switch v := val.(type) {
+	case time.Duration:
+		return v.String()
+	case slog.Level:
+		return v.String()
+	case LatePolicy:
+		return string(v)
+	case TracingExporter:
+		return string(v)
+	case models.Role:
+		return string(v)
+	case map[int]string:
+		items := make([]string, 0, len(v))
+		for _, sensorId := range sortedIds(v) {
+			items = append(items, strconv.Itoa(sensorId)+":"+v[sensorId])
+		}
+		return strings.Join(items, ",")
+	case map[int]float64:
+		items := make([]string, 0, len(v))
+		for _, sensorId := range sortedIds(v) {
+			items = append(items, strconv.Itoa(sensorId)+":"+strconv.FormatFloat(v[sensorId], 'g', -1, 64))
+		}
+		return strings.Join(items, ",")
+	case map[int]bool:
+		items := make([]string, 0, len(v))
+		for _, sensorId := range sortedIds(v) {
+			items = append(items, strconv.Itoa(sensorId))
+		}
+		return strings.Join(items, ",")
+	case map[string]ValueRange:
+		items := make([]string, 0, len(v))
+		for _, unit := range sortedKeys(v) {
+			items = append(items, unit+":"+strconv.FormatFloat(v[unit].Min, 'g', -1, 64)+":"+strconv.FormatFloat(v[unit].Max, 'g', -1, 64))
+		}
+		return strings.Join(items, ",")
+	case map[string]MetricMapping:
+		items := make([]string, 0, len(v))
+		for _, name := range sortedKeys(v) {
+			item := name + "=" + v[name].Metric
+			if v[name].Unit != "" {
+				item += ":" + v[name].Unit
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, ",")
+	case []netip.Prefix:
+		items := make([]string, len(v))
+		for i, prefix := range v {
+			items[i] = prefix.String()
+		}
+		return strings.Join(items, ",")
+	default:
+		return v
+	}
+}
+
+func sortedIds[V any](m map[int]V) []int {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Reloadable a component that re-creates the state of reloadable settings from a new config
+type Reloadable interface {
+	// PrepareReload builds the new state without applying it so an invalid e.g. TLS certificate changes nothing.
+	// The returned commit swaps the state in and can't fail.
+	PrepareReload(conf *SensordConf) (commit func(), err error)
+}
+
+// ReloadFunc adapts a func to the Reloadable
+type ReloadFunc func(conf *SensordConf) (func(), error)
+
+func (f ReloadFunc) PrepareReload(conf *SensordConf) (func(), error) {
+	return f(conf)
+}
+
+// ConfigChanges settings of a new config that differ from the effective config
+type ConfigChanges struct {
+	// Applied settings now have the new values
+	Applied []string
+	// RestartRequired settings keep the old values until a restart e.g. listen addresses
+	RestartRequired []string
+}
+
+// Reloader loads the config again e.g. on SIGHUP and applies its reloadable settings to the components
+type Reloader struct {
+	load       func() (*SensordConf, error)
+	mu         sync.Mutex
+	conf       *SensordConf
+	components []Reloadable
+}
+
+// NewReloader of the effective conf. The load reads and validates the new config.
+func NewReloader(conf *SensordConf, load func() (*SensordConf, error)) *Reloader {
+	return &Reloader{
+		load: load,
+		conf: conf,
+	}
+}
+
+// Add components that are prepared and committed on each reload
+func (r *Reloader) Add(components ...Reloadable) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.components = append(r.components, components...)
+}
+
+// Reload the config and the files it refers to. If the config is invalid or a component can't prepare then nothing is changed.
+// Otherwise all components switch to the new reloadable settings at once.
+func (r *Reloader) Reload() (*ConfigChanges, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	newConf, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	changes := diffConfig(r.conf, newConf)
+	// the components prepare even if no setting is changed because files e.g. a renewed certificate may be replaced in place
+	effective := mergeReloadable(r.conf, newConf)
+	commits := make([]func(), 0, len(r.components))
+	for _, component := range r.components {
+		commit, err := component.PrepareReload(effective)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	r.conf = effective
+	return changes, nil
+}
+
+// diffConfig names of changed settings
+func diffConfig(oldConf, newConf *SensordConf) *ConfigChanges {
+	changes := &ConfigChanges{Applied: []string{}, RestartRequired: []string{}}
+	oldValue := reflect.ValueOf(oldConf).Elem()
+	newValue := reflect.ValueOf(newConf).Elem()
+	for _, s := range settings {
+		if reflect.DeepEqual(oldValue.Field(s.field).Interface(), newValue.Field(s.field).Interface()) {
+			continue
+		}
+		if s.reload {
+			changes.Applied = append(changes.Applied, s.name)
+		} else {
+			changes.RestartRequired = append(changes.RestartRequired, s.name)
+		}
+	}
+	return changes
+}
+
+// mergeReloadable returns a copy of the oldConf with reloadable settings of the newConf
+func mergeReloadable(oldConf, newConf *SensordConf) *SensordConf {
+	merged := *oldConf
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	newValue := reflect.ValueOf(newConf).Elem()
+	for _, s := range settings {
+		if s.reload {
+			mergedValue.Field(s.field).Set(newValue.Field(s.field))
+		}
+	}
+	return &merged
+}
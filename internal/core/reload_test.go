@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// fakeComponent records the committed config
+type fakeComponent struct {
+	prepareErr error
+	committed  *SensordConf
+}
+
+func (c *fakeComponent) PrepareReload(conf *SensordConf) (func(), error) {
+	if c.prepareErr != nil {
+		return nil, c.prepareErr
+	}
+	return func() {
+		c.committed = conf
+	}, nil
+}
+
+func Test_Reloader_Reload(t *testing.T) {
+	conf := &SensordConf{SensorApiListenHttp: ":8080", SensorRateLimit: 1, SensorIdMax: 10}
+	newConf := &SensordConf{SensorApiListenHttp: ":8081", SensorRateLimit: 5, SensorIdMax: 10}
+	reloader := NewReloader(conf, func() (*SensordConf, error) {
+		return newConf, nil
+	})
+	component := &fakeComponent{}
+	reloader.Add(component)
+
+	changes, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SENSOR_RATE_LIMIT"}, changes.Applied)
+	assert.Equal(t, []string{"SENSOR_LISTEN_HTTP"}, changes.RestartRequired)
+	// the listen address keeps the old value
+	assert.Equal(t, ":8080", component.committed.SensorApiListenHttp)
+	assert.Equal(t, 5.0, component.committed.SensorRateLimit)
+
+	// the pending restart is still reported and the component reloads its files
+	component.committed = nil
+	changes, err = reloader.Reload()
+	assert.NoError(t, err)
+	assert.Empty(t, changes.Applied)
+	assert.Equal(t, []string{"SENSOR_LISTEN_HTTP"}, changes.RestartRequired)
+	assert.Equal(t, 5.0, component.committed.SensorRateLimit)
+}
+
+func Test_Reloader_Reload_Rejected(t *testing.T) {
+	conf := &SensordConf{SensorRateLimit: 1}
+	var loadErr error
+	reloader := NewReloader(conf, func() (*SensordConf, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return &SensordConf{SensorRateLimit: 5}, nil
+	})
+	committing := &fakeComponent{}
+	failing := &fakeComponent{prepareErr: errors.New("bad certificate")}
+	reloader.Add(committing, failing)
+
+	// invalid config
+	loadErr = errors.New("SENSOR_RATE_LIMIT must not be negative")
+	_, err := reloader.Reload()
+	assert.EqualError(t, err, "SENSOR_RATE_LIMIT must not be negative")
+	assert.Nil(t, committing.committed)
+
+	// a component can't prepare so nobody commits
+	loadErr = nil
+	_, err = reloader.Reload()
+	assert.EqualError(t, err, "bad certificate")
+	assert.Nil(t, committing.committed)
+
+	// the effective config is still the old one
+	failing.prepareErr = nil
+	changes, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SENSOR_RATE_LIMIT"}, changes.Applied)
+	assert.Equal(t, 5.0, committing.committed.SensorRateLimit)
+}
+
+func Test_Reloader_Reload_InvalidFile(t *testing.T) {
+	path := writeConfigFile(t, minimalConfig)
+	args := []string{"--config", path}
+	conf, err := LoadConfig(args)
+	assert.NoError(t, err)
+	reloader := NewReloader(conf, func() (*SensordConf, error) {
+		return LoadConfig(args)
+	})
+	component := &fakeComponent{}
+	reloader.Add(component)
+
+	// a range of a unit that validation never looks up
+	err = os.WriteFile(path, []byte(minimalConfig+"value_ranges: fahrenheit:-60:140"), 0o600)
+	assert.NoError(t, err)
+	_, err = reloader.Reload()
+	assert.ErrorContains(t, err, `VALUE_RANGES: unknown unit "fahrenheit"`)
+	assert.Nil(t, component.committed)
+}
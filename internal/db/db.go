@@ -6,14 +6,24 @@ import (
 	"time"
 )
 
+// SchemaVersion of the last migration in the /migration folder. Bump it with each new migration.
+const SchemaVersion = 5
+
 // SensorsDb is a generic DB interface
 type SensorsDb interface {
 	Connect(ctx context.Context) error
 	Close()
-	StoreMeasurement(ctx context.Context, day time.Time, sensorId int, value float64)
-	GetMeasurementStatsForDay(ctx context.Context, day time.Time, sensorId int) (*models.MeasurementRec, error)
-	GetMeasurementPeriodStatsTotal(ctx context.Context, periodStart, periodEnd time.Time) (*models.MeasurementRec, error)
-	GetMeasurementPeriodStatsForEachSensor(ctx context.Context, periodStart, periodEnd time.Time) ([]*models.MeasurementRec, error)
-	GetMeasurementPeriodStatsForEachSensorAndDay(ctx context.Context, periodStart, periodEnd time.Time) ([]*models.MeasurementRec, error)
+	Ping(ctx context.Context) error
+	GetSchemaVersion(ctx context.Context) (version int, dirty bool, err error)
+	StoreMeasurement(ctx context.Context, day time.Time, sensorId int, metric string, value float64, flags models.MeasurementFlags) error
+	GetMeasurementStatsForDay(ctx context.Context, day time.Time, sensorId int, metric string) (*models.MeasurementRec, error)
+	GetMeasurementPeriodStatsTotal(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error)
+	GetMeasurementPeriodStatsForEachSensor(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error)
+	GetMeasurementPeriodStatsForEachSensorAndDay(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error)
+	DeleteMeasurements(ctx context.Context, sensorId int) (int64, error)
+	GetAdminUser(ctx context.Context, username string) (*models.AdminUser, error)
+	ListAdminUsers(ctx context.Context) ([]*models.AdminUser, error)
+	StoreAdminUser(ctx context.Context, user *models.AdminUser) error
+	DeleteAdminUser(ctx context.Context, username string) (bool, error)
 	Cleanup(ctx context.Context)
 }
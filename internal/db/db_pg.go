@@ -5,49 +5,56 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/pkg/errors"
-	"log"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sensord/internal/metrics"
 	"sensord/internal/models"
+	"sensord/internal/tracing"
+	"strings"
 	"time"
 )
 
-// DbLog logger for SQL queries
-type DbLog struct {
-}
-
-func (l *DbLog) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
-	queryArgs := data["args"]
-	querySql := data["sql"]
-	log.Printf("DEBUG: SQL %s args: %v %s\n", msg, queryArgs, querySql)
-}
-
 type PostgresDb struct {
 	pool        *pgxpool.Pool
 	DatabaseUrl string
-	DatabaseLog bool
+	// MaxConns of the pool. Zero keeps the pgx default or the pool_max_conns of the DatabaseUrl.
+	MaxConns int
+	// MigrationsTable of golang-migrate e.g. `public.schema_migrations`. A table without a schema is looked up in the search_path.
+	MigrationsTable string
 }
 
-func NewPostgresDb(databaseUrl string, databaseLog bool) *PostgresDb {
+func NewPostgresDb(databaseUrl string, maxConns int, migrationsTable string) *PostgresDb {
 	return &PostgresDb{
-		DatabaseUrl: databaseUrl,
-		DatabaseLog: databaseLog,
+		DatabaseUrl:     databaseUrl,
+		MaxConns:        maxConns,
+		MigrationsTable: migrationsTable,
 	}
 }
 
+var tracer = otel.Tracer("sensord/internal/db")
+
+// startQuery starts a span of the query.
+// The Ping and the schema version of health checks aren't traced so frequent probes don't flood the traces.
+func startQuery(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.DBSystemPostgreSQL))
+}
+
 func (db *PostgresDb) Connect(ctx context.Context) error {
 	poolConfig, err := pgxpool.ParseConfig(db.DatabaseUrl)
 	if err != nil {
 		return errors.Wrap(err, "Unable to parse database URL.")
 	}
-	if db.DatabaseLog {
-		poolConfig.ConnConfig.Logger = &DbLog{}
-		poolConfig.ConnConfig.LogLevel = pgx.LogLevelTrace
+	if db.MaxConns > 0 {
+		poolConfig.MaxConns = int32(db.MaxConns)
 	}
 	pool, dbErr := pgxpool.ConnectConfig(ctx, poolConfig)
 	if dbErr != nil {
 		return dbErr
 	}
 	db.pool = pool
-	log.Printf("INFO: Connected to database\n")
+	slog.Info("Connected to database")
 	return nil
 }
 
@@ -57,119 +64,214 @@ func (db *PostgresDb) Close() {
 	}
 	db.pool.Close()
 	db.pool = nil
-	log.Printf("INFO: DB disconnected\n")
+	slog.Info("DB disconnected")
+}
+
+// Ping checks that the DB is reachable
+func (db *PostgresDb) Ping(ctx context.Context) error {
+	return db.pool.Ping(ctx)
 }
 
-// Cleanup DB e.g. remove sensors and all their measurements.
+// GetSchemaVersion of the last applied migration from the golang-migrate table.
+// The dirty is true if the migration failed in the middle.
+func (db *PostgresDb) GetSchemaVersion(ctx context.Context) (int, bool, error) {
+	var version int
+	var dirty bool
+	table := pgx.Identifier(strings.Split(db.MigrationsTable, ".")).Sanitize()
+	row := db.pool.QueryRow(ctx, `SELECT version, dirty FROM `+table+` LIMIT 1`)
+	err := row.Scan(&version, &dirty)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, dirty, nil
+}
+
+// Cleanup DB e.g. remove sensors and all their measurements and admin users.
 // Useful for testing
 func (db *PostgresDb) Cleanup(ctx context.Context) {
-	_, sqlErr := db.pool.Exec(ctx, `TRUNCATE measurement`)
+	_, sqlErr := db.pool.Exec(ctx, `TRUNCATE measurement, admin_user`)
 	if sqlErr != nil {
-		log.Printf("ERROR: Fail to cleanup %v\n", sqlErr)
+		slog.ErrorContext(ctx, "Fail to cleanup", "err", sqlErr)
 	}
 }
 
 // StoreMeasurement Saves the measurement for a day.
-// The value is stored in aggregated form for the day.
-// Total count, sum, min, max, avg values are updated.
-func (db *PostgresDb) StoreMeasurement(ctx context.Context, day time.Time, sensorId int, value float64) {
+// The value is stored in aggregated form for the day and the metric.
+// Total count, sum, M2 for the variance, min, max, avg values are updated.
+// The flags are counted e.g. a measurement that arrived after the lateness horizon is counted in the late_count.
+func (db *PostgresDb) StoreMeasurement(ctx context.Context, day time.Time, sensorId int, metric string, value float64, flags models.MeasurementFlags) error {
+	defer metrics.ObserveQuery("store_measurement", time.Now())
+	ctx, span := startQuery(ctx, "store_measurement")
+	defer span.End()
 	// UPSERT that tries to insert a row for a specific day but if the record already exists it updates it instead.
 	// All the fields are updated in aggregated form: count incremented, average recalculated etc
 	_, sqlErr := db.pool.Exec(ctx, `
 INSERT INTO measurement (
-	measurement_day, sensor_id, total_count, total_sum, avg_value, min_value, max_value) 
-VALUES ($1, $2, 1, $3, $3, $3, $3)
-ON CONFLICT (measurement_day, sensor_id) DO
-UPDATE SET total_sum = measurement.total_sum + $3, -- increase sum on the new measurement value
+	measurement_day, sensor_id, metric, total_count, total_sum, total_m2, avg_value, min_value, max_value,
+	late_count, server_time_count) 
+VALUES ($1, $2, $3, 1, $4, 0, $4, $4, $4, CASE WHEN $5 THEN 1 ELSE 0 END, CASE WHEN $6 THEN 1 ELSE 0 END)
+ON CONFLICT (measurement_day, sensor_id, metric) DO
+UPDATE SET total_sum = measurement.total_sum + $4, -- increase sum on the new measurement value
+-- Welford's method: add the deviation from the old average times the deviation from the new average.
+-- It stays NULL for a day stored before the variance was tracked.
+total_m2 = measurement.total_m2 + ($4 - measurement.avg_value) * ($4 - (measurement.total_sum + $4) / (measurement.total_count + 1)),
 total_count = measurement.total_count + 1, -- increment count
-avg_value = (measurement.total_sum + $3) / (measurement.total_count + 1), -- calculate a new average
-min_value = LEAST(measurement.min_value, $3), -- find minimal value
-max_value = GREATEST(measurement.max_value, $3) -- find maximal value
-WHERE measurement.measurement_day = $1 AND measurement.sensor_id = $2
+late_count = measurement.late_count + CASE WHEN $5 THEN 1 ELSE 0 END, -- increment late count
+server_time_count = measurement.server_time_count + CASE WHEN $6 THEN 1 ELSE 0 END, -- increment server time count
+avg_value = (measurement.total_sum + $4) / (measurement.total_count + 1), -- calculate a new average
+min_value = LEAST(measurement.min_value, $4), -- find minimal value
+max_value = GREATEST(measurement.max_value, $4) -- find maximal value
+WHERE measurement.measurement_day = $1 AND measurement.sensor_id = $2 AND measurement.metric = $3
 `,
-		day, sensorId, value)
+		day, sensorId, metric, value, flags.Has(models.FlagLate), flags.Has(models.FlagServerTime))
 	if sqlErr != nil {
-		log.Printf("ERROR: Fail to insert measure %v\n", sqlErr)
+		// logged by the caller with sampling so a DB outage doesn't flood the logs
+		return tracing.Fail(span, sqlErr)
 	}
+	return nil
 }
 
 // GetMeasurementStatsForDay returns a stats for a day.
 // If no any measurements exists for the day then all counters will be zero.
-func (db *PostgresDb) GetMeasurementStatsForDay(ctx context.Context, day time.Time, sensorId int) (*models.MeasurementRec, error) {
+func (db *PostgresDb) GetMeasurementStatsForDay(ctx context.Context, day time.Time, sensorId int, metric string) (*models.MeasurementRec, error) {
+	defer metrics.ObserveQuery("stats_for_day", time.Now())
+	ctx, span := startQuery(ctx, "stats_for_day")
+	defer span.End()
 	row := db.pool.QueryRow(ctx, `
-SELECT total_count, total_sum, avg_value, min_value, max_value
+SELECT total_count, total_sum, avg_value, min_value, max_value,
+	total_m2 / total_count AS variance_value,
+	late_count, server_time_count
 FROM measurement
-WHERE measurement_day = $1 AND sensor_id = $2`,
-		day, sensorId)
+WHERE measurement_day = $1 AND sensor_id = $2 AND metric = $3`,
+		day, sensorId, metric)
 
 	measurement := &models.MeasurementRec{}
 	sqlErr := row.Scan(&measurement.TotalCount, &measurement.TotalSum,
-		&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue)
+		&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue, &measurement.Variance,
+		&measurement.LateCount, &measurement.ServerTimeCount)
 	if sqlErr == pgx.ErrNoRows {
 		return measurement, nil
 	}
 	if sqlErr != nil {
-		return nil, sqlErr
+		return nil, tracing.Fail(span, sqlErr)
 	}
 	return measurement, nil
 }
 
-// GetMeasurementPeriodStatsTotal returns a stats for a period e.g. day, week.
-// If no any measurements exists for the day then all counters will be zero.
-func (db *PostgresDb) GetMeasurementPeriodStatsTotal(ctx context.Context, periodStart, periodEnd time.Time) (*models.MeasurementRec, error) {
-	row := db.pool.QueryRow(ctx, `
+// filterSensorIds returns sensors of the filter or nil for all sensors
+func filterSensorIds(filter *models.StatsFilter) []int {
+	if filter == nil {
+		return nil
+	}
+	return filter.SensorIds
+}
+
+// filterMetric returns the metric of the filter or empty for all metrics
+func filterMetric(filter *models.StatsFilter) string {
+	if filter == nil {
+		return ""
+	}
+	return filter.Metric
+}
+
+// GetMeasurementPeriodStatsTotal returns a stats for a period e.g. day, week for each metric.
+// If no any measurements exists for the period then the result is empty.
+func (db *PostgresDb) GetMeasurementPeriodStatsTotal(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error) {
+	defer metrics.ObserveQuery("stats_total", time.Now())
+	ctx, span := startQuery(ctx, "stats_total")
+	defer span.End()
+	stats := []*models.MeasurementRec{}
+
+	rows, sqlErr := db.pool.Query(ctx, `
 SELECT
+	metric,
 	SUM(total_count) AS total_count,
 	SUM(total_sum) AS total_sum,
 	SUM(total_sum) / SUM(total_count) AS avg_value,
 	MIN(min_value) AS min_value,
-	MAX(max_value) AS max_value
-FROM measurement
-WHERE measurement_day >= $1 AND measurement_day < $2
-HAVING COUNT(*) > 0 -- remove records with all NULL
+	MAX(max_value) AS max_value,
+	-- population variance of the days combined: M2 of each day plus the deviation of the day's average
+	-- from the period's average. NULL if any day was stored before the variance was tracked.
+	CASE WHEN COUNT(total_m2) = COUNT(*) THEN
+		(SUM(total_m2) + SUM(total_count * POWER(avg_value - period_avg, 2))) / SUM(total_count)
+	END AS variance_value,
+	SUM(late_count) AS late_count,
+	SUM(server_time_count) AS server_time_count
+FROM (
+	SELECT *, SUM(total_sum) OVER w / SUM(total_count) OVER w AS period_avg
+	FROM measurement
+	WHERE measurement_day >= $1 AND measurement_day < $2
+	AND ($3::INT[] IS NULL OR sensor_id = ANY($3))
+	AND ($4 = '' OR metric = $4)
+	WINDOW w AS (PARTITION BY metric)
+) AS m
+GROUP BY metric
+ORDER BY metric
 `,
-		periodStart, periodEnd)
+		periodStart, periodEnd, filterSensorIds(filter), filterMetric(filter))
 
-	measurement := &models.MeasurementRec{
-		PeriodStart: periodStart,
-		PeriodEnd:   periodEnd,
-		SensorId:    0,
+	if sqlErr != nil {
+		return nil, tracing.Fail(span, sqlErr)
 	}
-	scanErr := row.Scan(&measurement.TotalCount, &measurement.TotalSum,
-		&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue)
+	defer rows.Close()
 
-	if scanErr == pgx.ErrNoRows {
-		return measurement, nil
-	}
-	if scanErr != nil {
-		log.Printf("ERROR: scan error %v\n", scanErr)
-		return nil, scanErr
+	for rows.Next() {
+		measurement := &models.MeasurementRec{
+			PeriodStart: periodStart,
+			PeriodEnd:   periodEnd,
+			SensorId:    0,
+		}
+		scanErr := rows.Scan(&measurement.Metric, &measurement.TotalCount, &measurement.TotalSum,
+			&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue, &measurement.Variance,
+			&measurement.LateCount, &measurement.ServerTimeCount)
+		if scanErr != nil {
+			slog.ErrorContext(ctx, "Unable to scan a row", "err", scanErr)
+			continue
+		}
+		stats = append(stats, measurement)
 	}
-	return measurement, nil
+	return stats, nil
 }
 
-// GetMeasurementPeriodStatsForEachSensor returns a stats for a period e.g. day, week.
-// If no any measurements exists for the day then all counters will be zero.
-func (db *PostgresDb) GetMeasurementPeriodStatsForEachSensor(ctx context.Context, periodStart, periodEnd time.Time) ([]*models.MeasurementRec, error) {
+// GetMeasurementPeriodStatsForEachSensor returns a stats for a period e.g. day, week for each sensor and metric.
+// If no any measurements exists for the period then the result is empty.
+func (db *PostgresDb) GetMeasurementPeriodStatsForEachSensor(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error) {
+	defer metrics.ObserveQuery("stats_each_sensor", time.Now())
+	ctx, span := startQuery(ctx, "stats_each_sensor")
+	defer span.End()
 	stats := []*models.MeasurementRec{}
 
 	rows, sqlErr := db.pool.Query(ctx, `
 SELECT
 	sensor_id,
+	metric,
 	SUM(total_count) AS total_count,
 	SUM(total_sum) AS total_sum,
 	SUM(total_sum) / SUM(total_count) AS avg_value,
 	MIN(min_value) AS min_value,
-	MAX(max_value) AS max_value
-FROM measurement
-WHERE measurement_day >= $1 AND measurement_day < $2
-GROUP BY sensor_id
-ORDER BY sensor_id
+	MAX(max_value) AS max_value,
+	-- population variance of the days combined: M2 of each day plus the deviation of the day's average
+	-- from the period's average. NULL if any day was stored before the variance was tracked.
+	CASE WHEN COUNT(total_m2) = COUNT(*) THEN
+		(SUM(total_m2) + SUM(total_count * POWER(avg_value - period_avg, 2))) / SUM(total_count)
+	END AS variance_value,
+	SUM(late_count) AS late_count,
+	SUM(server_time_count) AS server_time_count
+FROM (
+	SELECT *, SUM(total_sum) OVER w / SUM(total_count) OVER w AS period_avg
+	FROM measurement
+	WHERE measurement_day >= $1 AND measurement_day < $2
+	AND ($3::INT[] IS NULL OR sensor_id = ANY($3))
+	AND ($4 = '' OR metric = $4)
+	WINDOW w AS (PARTITION BY sensor_id, metric)
+) AS m
+GROUP BY sensor_id, metric
+ORDER BY sensor_id, metric
 `,
-		periodStart, periodEnd)
+		periodStart, periodEnd, filterSensorIds(filter), filterMetric(filter))
 
 	if sqlErr != nil {
-		return nil, sqlErr
+		return nil, tracing.Fail(span, sqlErr)
 	}
 	defer rows.Close()
 
@@ -178,10 +280,11 @@ ORDER BY sensor_id
 			PeriodStart: periodStart,
 			PeriodEnd:   periodEnd,
 		}
-		scanErr := rows.Scan(&measurement.SensorId, &measurement.TotalCount, &measurement.TotalSum,
-			&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue)
+		scanErr := rows.Scan(&measurement.SensorId, &measurement.Metric, &measurement.TotalCount, &measurement.TotalSum,
+			&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue, &measurement.Variance,
+			&measurement.LateCount, &measurement.ServerTimeCount)
 		if scanErr != nil {
-			log.Printf("ERROR: scan error %v\n", scanErr)
+			slog.ErrorContext(ctx, "Unable to scan a row", "err", scanErr)
 			continue
 		}
 		stats = append(stats, measurement)
@@ -189,38 +292,49 @@ ORDER BY sensor_id
 	return stats, nil
 }
 
-// GetMeasurementPeriodStatsForEachSensorAndDay returns a stats for a period e.g. day, week.
-// If no any measurements exists for the day then all counters will be zero.
-func (db *PostgresDb) GetMeasurementPeriodStatsForEachSensorAndDay(ctx context.Context, periodStart, periodEnd time.Time) ([]*models.MeasurementRec, error) {
+// GetMeasurementPeriodStatsForEachSensorAndDay returns a stats for a period e.g. day, week for each sensor, metric and day.
+// If no any measurements exists for the period then the result is empty.
+func (db *PostgresDb) GetMeasurementPeriodStatsForEachSensorAndDay(ctx context.Context, periodStart, periodEnd time.Time, filter *models.StatsFilter) ([]*models.MeasurementRec, error) {
+	defer metrics.ObserveQuery("stats_each_sensor_and_day", time.Now())
+	ctx, span := startQuery(ctx, "stats_each_sensor_and_day")
+	defer span.End()
 	stats := []*models.MeasurementRec{}
 
 	rows, sqlErr := db.pool.Query(ctx, `
 SELECT
 	sensor_id,
+	metric,
 	measurement_day,
 	SUM(total_count) AS total_count,
 	SUM(total_sum) AS total_sum,
 	SUM(total_sum) / SUM(total_count) AS avg_value,
 	MIN(min_value) AS min_value,
-	MAX(max_value) AS max_value
+	MAX(max_value) AS max_value,
+	-- population variance of the day. NULL if the day was stored before the variance was tracked
+	SUM(total_m2) / SUM(total_count) AS variance_value,
+	SUM(late_count) AS late_count,
+	SUM(server_time_count) AS server_time_count
 FROM measurement
 WHERE measurement_day >= $1 AND measurement_day < $2
-GROUP BY sensor_id, measurement_day
-ORDER BY sensor_id, measurement_day
+AND ($3::INT[] IS NULL OR sensor_id = ANY($3))
+AND ($4 = '' OR metric = $4)
+GROUP BY sensor_id, metric, measurement_day
+ORDER BY sensor_id, metric, measurement_day
 `,
-		periodStart, periodEnd)
+		periodStart, periodEnd, filterSensorIds(filter), filterMetric(filter))
 
 	if sqlErr != nil {
-		return nil, sqlErr
+		return nil, tracing.Fail(span, sqlErr)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		measurement := &models.MeasurementRec{}
-		scanErr := rows.Scan(&measurement.SensorId, &measurement.PeriodStart, &measurement.TotalCount, &measurement.TotalSum,
-			&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue)
+		scanErr := rows.Scan(&measurement.SensorId, &measurement.Metric, &measurement.PeriodStart, &measurement.TotalCount, &measurement.TotalSum,
+			&measurement.AvgValue, &measurement.MinValue, &measurement.MaxValue, &measurement.Variance,
+			&measurement.LateCount, &measurement.ServerTimeCount)
 		if scanErr != nil {
-			log.Printf("ERROR: scan error %v\n", scanErr)
+			slog.ErrorContext(ctx, "Unable to scan a row", "err", scanErr)
 			continue
 		}
 		measurement.PeriodEnd = measurement.PeriodStart.AddDate(0, 0, 1)
@@ -228,3 +342,91 @@ ORDER BY sensor_id, measurement_day
 	}
 	return stats, nil
 }
+
+// DeleteMeasurements removes all measurements of the sensor and returns a number of removed days
+func (db *PostgresDb) DeleteMeasurements(ctx context.Context, sensorId int) (int64, error) {
+	ctx, span := startQuery(ctx, "delete_measurements")
+	defer span.End()
+	tag, sqlErr := db.pool.Exec(ctx, `DELETE FROM measurement WHERE sensor_id = $1`, sensorId)
+	if sqlErr != nil {
+		return 0, tracing.Fail(span, sqlErr)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetAdminUser returns the user or nil if the user doesn't exist
+func (db *PostgresDb) GetAdminUser(ctx context.Context, username string) (*models.AdminUser, error) {
+	ctx, span := startQuery(ctx, "get_admin_user")
+	defer span.End()
+	row := db.pool.QueryRow(ctx, `
+SELECT username, password_hash, role, sensor_ids
+FROM admin_user
+WHERE username = $1`,
+		username)
+
+	user := &models.AdminUser{}
+	sqlErr := row.Scan(&user.Username, &user.PasswordHash, &user.Role, &user.SensorIds)
+	if sqlErr == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if sqlErr != nil {
+		return nil, tracing.Fail(span, sqlErr)
+	}
+	return user, nil
+}
+
+// ListAdminUsers returns all users ordered by username
+func (db *PostgresDb) ListAdminUsers(ctx context.Context) ([]*models.AdminUser, error) {
+	ctx, span := startQuery(ctx, "list_admin_users")
+	defer span.End()
+	users := []*models.AdminUser{}
+
+	rows, sqlErr := db.pool.Query(ctx, `
+SELECT username, password_hash, role, sensor_ids
+FROM admin_user
+ORDER BY username`)
+
+	if sqlErr != nil {
+		return nil, tracing.Fail(span, sqlErr)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user := &models.AdminUser{}
+		scanErr := rows.Scan(&user.Username, &user.PasswordHash, &user.Role, &user.SensorIds)
+		if scanErr != nil {
+			slog.ErrorContext(ctx, "Unable to scan a row", "err", scanErr)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// StoreAdminUser creates or updates the user
+func (db *PostgresDb) StoreAdminUser(ctx context.Context, user *models.AdminUser) error {
+	ctx, span := startQuery(ctx, "store_admin_user")
+	defer span.End()
+	_, sqlErr := db.pool.Exec(ctx, `
+INSERT INTO admin_user (username, password_hash, role, sensor_ids)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (username) DO
+UPDATE SET password_hash = $2, role = $3, sensor_ids = $4
+`,
+		user.Username, user.PasswordHash, user.Role, user.SensorIds)
+	if sqlErr != nil {
+		return tracing.Fail(span, sqlErr)
+	}
+	return nil
+}
+
+// DeleteAdminUser removes the user and returns false if the user didn't exist
+func (db *PostgresDb) DeleteAdminUser(ctx context.Context, username string) (bool, error) {
+	ctx, span := startQuery(ctx, "delete_admin_user")
+	defer span.End()
+	tag, sqlErr := db.pool.Exec(ctx, `DELETE FROM admin_user WHERE username = $1`, username)
+	if sqlErr != nil {
+		return false, tracing.Fail(span, sqlErr)
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -30,6 +30,9 @@ var day7 = time.Date(2023, 1, 7, 0, 0, 0, 0, utc)
 // next week
 var day8 = time.Date(2023, 1, 8, 0, 0, 0, 0, utc)
 
+// zeroVariance of equal values
+var zeroVariance = 0.0
+
 var storage SensorsDb
 
 const (
@@ -77,7 +80,7 @@ func TestMain(m *testing.M) {
 	log.Println("migration done")
 
 	databaseUrlAndSchema := databaseUrl + "&search_path=sensors"
-	storage = NewPostgresDb(databaseUrlAndSchema, true)
+	storage = NewPostgresDb(databaseUrlAndSchema, 0, "public.schema_migrations")
 	dbErr := storage.Connect(ctx)
 	if dbErr != nil {
 		fmt.Printf("Connection error: %s\n", dbErr)
@@ -129,14 +132,14 @@ func Test_StoreMeasurement(t *testing.T) {
 	ctx := context.Background()
 	storage.Cleanup(ctx)
 	// check that for the day we don't have any measurements
-	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1)
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
 	assert.NoError(t, sqlErr)
 	expected := &models.MeasurementRec{}
 	assert.Equal(t, expected, measurement)
 
 	// Insert the first record for a day
-	storage.StoreMeasurement(ctx, day1, 1, 1.0)
-	measurement, sqlErr = storage.GetMeasurementStatsForDay(ctx, day1, 1)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	measurement, sqlErr = storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
 	assert.NoError(t, sqlErr)
 	expected = &models.MeasurementRec{
 		TotalCount: 1,
@@ -144,13 +147,14 @@ func Test_StoreMeasurement(t *testing.T) {
 		AvgValue:   1,
 		MinValue:   1,
 		MaxValue:   1,
+		Variance:   &zeroVariance,
 	}
 	assert.Equal(t, expected, measurement)
-	storage.StoreMeasurement(ctx, day1, 1, 2.0)
-	storage.StoreMeasurement(ctx, day1, 1, 3.0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 2.0, 0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 3.0, 0)
 	// add a record for tomorrow
-	storage.StoreMeasurement(ctx, day2, 1, 4.0)
-	measurement, sqlErr = storage.GetMeasurementStatsForDay(ctx, day1, 1)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 4.0, 0)
+	measurement, sqlErr = storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
 	assert.NoError(t, sqlErr)
 	expected = &models.MeasurementRec{
 		TotalCount: 3,
@@ -159,6 +163,11 @@ func Test_StoreMeasurement(t *testing.T) {
 		MinValue:   1,
 		MaxValue:   3,
 	}
+	// variance of 1, 2, 3
+	if assert.NotNil(t, measurement.Variance) {
+		assert.InDelta(t, 2.0/3, *measurement.Variance, 1e-9)
+	}
+	expected.Variance = measurement.Variance
 	assert.Equal(t, expected, measurement)
 }
 
@@ -171,12 +180,12 @@ func Test_StoreMeasurement_Parallel(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			storage.StoreMeasurement(ctx, day3, 1, 1.0)
+			storage.StoreMeasurement(ctx, day3, 1, models.DefaultMetric, 1.0, 0)
 		}()
 	}
 
 	wg.Wait()
-	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day3, 1)
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day3, 1, models.DefaultMetric)
 	assert.NoError(t, sqlErr)
 	expected := &models.MeasurementRec{
 		TotalCount: 100,
@@ -184,6 +193,7 @@ func Test_StoreMeasurement_Parallel(t *testing.T) {
 		AvgValue:   1,
 		MinValue:   1,
 		MaxValue:   1,
+		Variance:   &zeroVariance,
 	}
 	assert.Equal(t, expected, measurement)
 }
@@ -191,64 +201,70 @@ func Test_StoreMeasurement_Parallel(t *testing.T) {
 func Test_GetMeasurementPeriodStatsTotal(t *testing.T) {
 	ctx := context.Background()
 	storage.Cleanup(ctx)
-	storage.StoreMeasurement(ctx, day1, 1, 1.0)
-	storage.StoreMeasurement(ctx, day1, 2, 1.0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, models.DefaultMetric, 1.0, 0)
 
-	storage.StoreMeasurement(ctx, day2, 1, 1.0)
-	storage.StoreMeasurement(ctx, day2, 2, 1.0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day2, 2, models.DefaultMetric, 1.0, 0)
 	// next week
-	storage.StoreMeasurement(ctx, day8, 1, 1.0)
-	storage.StoreMeasurement(ctx, day8, 2, 1.0)
+	storage.StoreMeasurement(ctx, day8, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day8, 2, models.DefaultMetric, 1.0, 0)
 
-	stats, sqlErr := storage.GetMeasurementPeriodStatsTotal(ctx, day1, day7)
+	stats, sqlErr := storage.GetMeasurementPeriodStatsTotal(ctx, day1, day7, nil)
 	assert.NoError(t, sqlErr)
-	expected := &models.MeasurementRec{
+	expected := []*models.MeasurementRec{{
 		PeriodStart: day1,
 		PeriodEnd:   day7,
 		SensorId:    0,
+		Metric:      models.DefaultMetric,
 		TotalCount:  4,
 		TotalSum:    4,
 		AvgValue:    1,
 		MinValue:    1,
 		MaxValue:    1,
-	}
+		Variance:    &zeroVariance,
+	}}
 	assert.Equal(t, expected, stats)
 }
 
 func Test_GetMeasurementPeriodStatsForEachSensor(t *testing.T) {
 	ctx := context.Background()
 	storage.Cleanup(ctx)
-	storage.StoreMeasurement(ctx, day1, 1, 1.0)
-	storage.StoreMeasurement(ctx, day1, 2, 1.0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, models.DefaultMetric, 1.0, 0)
 
-	storage.StoreMeasurement(ctx, day2, 1, 1.0)
-	storage.StoreMeasurement(ctx, day2, 2, 1.0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day2, 2, models.DefaultMetric, 1.0, 0)
 	// next week
-	storage.StoreMeasurement(ctx, day8, 1, 1.0)
-	storage.StoreMeasurement(ctx, day8, 2, 1.0)
+	storage.StoreMeasurement(ctx, day8, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day8, 2, models.DefaultMetric, 1.0, 0)
 
-	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7)
+	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, nil)
 	assert.NoError(t, sqlErr)
 	expected := []*models.MeasurementRec{
 		{
 			PeriodStart: day1,
 			PeriodEnd:   day7,
 			SensorId:    1,
+			Metric:      models.DefaultMetric,
 			TotalCount:  2,
 			TotalSum:    2,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 		{
 			PeriodStart: day1,
 			PeriodEnd:   day7,
 			SensorId:    2,
+			Metric:      models.DefaultMetric,
 			TotalCount:  2,
 			TotalSum:    2,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 	}
 
@@ -258,59 +274,262 @@ func Test_GetMeasurementPeriodStatsForEachSensor(t *testing.T) {
 func Test_GetMeasurementPeriodStatsForEachSensorAndDay(t *testing.T) {
 	ctx := context.Background()
 	storage.Cleanup(ctx)
-	storage.StoreMeasurement(ctx, day1, 1, 1.0)
-	storage.StoreMeasurement(ctx, day1, 2, 1.0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, models.DefaultMetric, 1.0, 0)
 
-	storage.StoreMeasurement(ctx, day2, 1, 1.0)
-	storage.StoreMeasurement(ctx, day2, 2, 1.0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day2, 2, models.DefaultMetric, 1.0, 0)
 	// next week
-	storage.StoreMeasurement(ctx, day8, 1, 1.0)
-	storage.StoreMeasurement(ctx, day8, 2, 1.0)
+	storage.StoreMeasurement(ctx, day8, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day8, 2, models.DefaultMetric, 1.0, 0)
 
-	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, day1, day7)
+	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, day1, day7, nil)
 	assert.NoError(t, sqlErr)
 	expected := []*models.MeasurementRec{
 		{
 			PeriodStart: day1,
 			PeriodEnd:   day2,
 			SensorId:    1,
+			Metric:      models.DefaultMetric,
 			TotalCount:  1,
 			TotalSum:    1,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 		{
 			PeriodStart: day2,
 			PeriodEnd:   day3,
 			SensorId:    1,
+			Metric:      models.DefaultMetric,
 			TotalCount:  1,
 			TotalSum:    1,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 		{
 			PeriodStart: day1,
 			PeriodEnd:   day2,
 			SensorId:    2,
+			Metric:      models.DefaultMetric,
 			TotalCount:  1,
 			TotalSum:    1,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 		{
 			PeriodStart: day2,
 			PeriodEnd:   day3,
 			SensorId:    2,
+			Metric:      models.DefaultMetric,
 			TotalCount:  1,
 			TotalSum:    1,
 			AvgValue:    1,
 			MinValue:    1,
 			MaxValue:    1,
+			Variance:    &zeroVariance,
 		},
 	}
 
 	assert.Equal(t, expected, stats)
 }
+
+func Test_GetMeasurementPeriodStatsForEachSensor_FilterSensors(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, models.DefaultMetric, 2.0, 0)
+	storage.StoreMeasurement(ctx, day1, 3, models.DefaultMetric, 3.0, 0)
+
+	filter := &models.StatsFilter{SensorIds: []int{2, 3}}
+	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, filter)
+	assert.NoError(t, sqlErr)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, 2, stats[0].SensorId)
+	assert.Equal(t, 3, stats[1].SensorId)
+
+	total, sqlErr := storage.GetMeasurementPeriodStatsTotal(ctx, day1, day7, filter)
+	assert.NoError(t, sqlErr)
+	assert.Len(t, total, 1)
+	assert.Equal(t, int64(2), total[0].TotalCount)
+	assert.Equal(t, 2.0, total[0].MinValue)
+
+	// scoped to no sensors
+	stats, sqlErr = storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, &models.StatsFilter{SensorIds: []int{}})
+	assert.NoError(t, sqlErr)
+	assert.Empty(t, stats)
+}
+
+func Test_DeleteMeasurements(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, models.DefaultMetric, 1.0, 0)
+
+	deleted, sqlErr := storage.DeleteMeasurements(ctx, 1)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, int64(2), deleted)
+
+	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 2, stats[0].SensorId)
+}
+
+func Test_AdminUser(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	user, sqlErr := storage.GetAdminUser(ctx, "yochbad")
+	assert.NoError(t, sqlErr)
+	assert.Nil(t, user)
+
+	viewer := &models.AdminUser{
+		Username:     "yochbad",
+		PasswordHash: "$2a$04$hash",
+		Role:         models.RoleViewer,
+		SensorIds:    []int{1, 2},
+	}
+	assert.NoError(t, storage.StoreAdminUser(ctx, viewer))
+	admin := &models.AdminUser{
+		Username:     "admin",
+		PasswordHash: "$2a$04$hash",
+		Role:         models.RoleAdmin,
+	}
+	assert.NoError(t, storage.StoreAdminUser(ctx, admin))
+
+	user, sqlErr = storage.GetAdminUser(ctx, "yochbad")
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, viewer, user)
+
+	// update
+	viewer.Role = models.RoleOperator
+	viewer.SensorIds = nil
+	assert.NoError(t, storage.StoreAdminUser(ctx, viewer))
+
+	users, sqlErr := storage.ListAdminUsers(ctx)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, []*models.AdminUser{admin, viewer}, users)
+
+	deleted, sqlErr := storage.DeleteAdminUser(ctx, "yochbad")
+	assert.NoError(t, sqlErr)
+	assert.True(t, deleted)
+	deleted, sqlErr = storage.DeleteAdminUser(ctx, "yochbad")
+	assert.NoError(t, sqlErr)
+	assert.False(t, deleted)
+}
+
+func Test_GetMeasurementPeriodStatsTotal_Metrics(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	storage.StoreMeasurement(ctx, day1, 1, "temperature", 20.0, 0)
+	storage.StoreMeasurement(ctx, day1, 1, "humidity", 40.0, 0)
+	storage.StoreMeasurement(ctx, day1, 2, "humidity", 60.0, 0)
+
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1, "humidity")
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, 40.0, measurement.AvgValue)
+
+	stats, sqlErr := storage.GetMeasurementPeriodStatsTotal(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, "humidity", stats[0].Metric)
+	assert.Equal(t, int64(2), stats[0].TotalCount)
+	assert.Equal(t, 50.0, stats[0].AvgValue)
+	assert.Equal(t, "temperature", stats[1].Metric)
+	assert.Equal(t, 20.0, stats[1].AvgValue)
+
+	stats, sqlErr = storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, &models.StatsFilter{Metric: "humidity"})
+	assert.NoError(t, sqlErr)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, "humidity", stats[0].Metric)
+	assert.Equal(t, "humidity", stats[1].Metric)
+}
+
+func Test_StoreMeasurement_Late(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, 0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 2.0, models.FlagLate)
+
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, int64(2), measurement.TotalCount)
+	assert.Equal(t, int64(1), measurement.LateCount)
+
+	stats, sqlErr := storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, int64(1), stats[0].LateCount)
+}
+
+func Test_StoreMeasurement_ServerTime(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1.0, models.FlagServerTime)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 2.0, models.FlagServerTime|models.FlagLate)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 3.0, 0)
+
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, int64(3), measurement.TotalCount)
+	assert.Equal(t, int64(1), measurement.LateCount)
+	assert.Equal(t, int64(2), measurement.ServerTimeCount)
+}
+
+func Test_GetMeasurementPeriodStats_Variance(t *testing.T) {
+	ctx := context.Background()
+	storage.Cleanup(ctx)
+	// large values lose precision with the sum of squares
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1e9+1, 0)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1e9+3, 0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1e9+5, 0)
+	storage.StoreMeasurement(ctx, day2, 1, models.DefaultMetric, 1e9+7, 0)
+
+	// variance of 1, 3, 5, 7
+	stats, sqlErr := storage.GetMeasurementPeriodStatsTotal(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	if assert.NotNil(t, stats[0].Variance) {
+		assert.InDelta(t, 5.0, *stats[0].Variance, 1e-6)
+	}
+	stats, sqlErr = storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	if assert.NotNil(t, stats[0].Variance) {
+		assert.InDelta(t, 1.0, *stats[0].Variance, 1e-6)
+	}
+
+	// a day stored before the variance was tracked
+	_, sqlErr = storage.(*PostgresDb).pool.Exec(ctx, `UPDATE measurement SET total_m2 = NULL WHERE measurement_day = $1`, day1)
+	assert.NoError(t, sqlErr)
+	storage.StoreMeasurement(ctx, day1, 1, models.DefaultMetric, 1e9+9, 0)
+	measurement, sqlErr := storage.GetMeasurementStatsForDay(ctx, day1, 1, models.DefaultMetric)
+	assert.NoError(t, sqlErr)
+	assert.Nil(t, measurement.Variance)
+	stats, sqlErr = storage.GetMeasurementPeriodStatsForEachSensor(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	assert.Nil(t, stats[0].Variance)
+	stats, sqlErr = storage.GetMeasurementPeriodStatsForEachSensorAndDay(ctx, day1, day7, nil)
+	assert.NoError(t, sqlErr)
+	assert.Nil(t, stats[0].Variance)
+	assert.NotNil(t, stats[1].Variance)
+}
+
+func Test_GetSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	assert.NoError(t, storage.Ping(ctx))
+
+	version, dirty, sqlErr := storage.GetSchemaVersion(ctx)
+	assert.NoError(t, sqlErr)
+	assert.Equal(t, SchemaVersion, version)
+	assert.False(t, dirty)
+
+	// the migrations ran without the search_path so their table isn't in the sensors schema
+	pgStorage := storage.(*PostgresDb)
+	sensorsSchema := &PostgresDb{pool: pgStorage.pool, MigrationsTable: "schema_migrations"}
+	_, _, sqlErr = sensorsSchema.GetSchemaVersion(ctx)
+	assert.Error(t, sqlErr)
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector exports the pgxpool statistics on each scrape
+type poolCollector struct {
+	db                   *PostgresDb
+	acquiredConns        *prometheus.Desc
+	idleConns            *prometheus.Desc
+	constructingConns    *prometheus.Desc
+	totalConns           *prometheus.Desc
+	maxConns             *prometheus.Desc
+	acquireCount         *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+}
+
+// PoolCollector of the DB connection pool metrics
+func (db *PostgresDb) PoolCollector() prometheus.Collector {
+	return &poolCollector{
+		db:                   db,
+		acquiredConns:        prometheus.NewDesc("sensord_db_pool_acquired_conns", "Connections currently in use.", nil, nil),
+		idleConns:            prometheus.NewDesc("sensord_db_pool_idle_conns", "Idle connections.", nil, nil),
+		constructingConns:    prometheus.NewDesc("sensord_db_pool_constructing_conns", "Connections being established.", nil, nil),
+		totalConns:           prometheus.NewDesc("sensord_db_pool_total_conns", "All connections of the pool.", nil, nil),
+		maxConns:             prometheus.NewDesc("sensord_db_pool_max_conns", "Maximum size of the pool.", nil, nil),
+		acquireCount:         prometheus.NewDesc("sensord_db_pool_acquires_total", "Successful acquires of a connection.", nil, nil),
+		acquireDuration:      prometheus.NewDesc("sensord_db_pool_acquire_duration_seconds_total", "Time spent on acquiring connections.", nil, nil),
+		emptyAcquireCount:    prometheus.NewDesc("sensord_db_pool_empty_acquires_total", "Acquires that waited for a connection because the pool was empty.", nil, nil),
+		canceledAcquireCount: prometheus.NewDesc("sensord_db_pool_canceled_acquires_total", "Acquires canceled by a context.", nil, nil),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.constructingConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.acquireDuration
+	ch <- c.emptyAcquireCount
+	ch <- c.canceledAcquireCount
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	pool := c.db.pool
+	if pool == nil {
+		return
+	}
+	stat := pool.Stat()
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+}
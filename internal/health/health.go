@@ -0,0 +1,83 @@
+package health
+
+import (
+	"context"
+	"sensord/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout of all the readiness checks
+const checkTimeout = 2 * time.Second
+
+// Check returns an error if the component can't serve
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health is the readiness of sensord components.
+// It's unready during the shutdown drain so a load balancer stops sending new requests.
+type Health struct {
+	mu       sync.Mutex
+	checks   []namedCheck
+	draining atomic.Bool
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddCheck of a component
+func (h *Health) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name, check})
+}
+
+// SetDraining on shutdown
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Readiness runs all the checks concurrently
+func (h *Health) Readiness(ctx context.Context) *models.ReadinessDto {
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	readiness := &models.ReadinessDto{
+		Ready:      true,
+		Draining:   h.draining.Load(),
+		Components: make([]*models.ComponentStatusDto, len(checks)),
+	}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check namedCheck) {
+			defer wg.Done()
+			component := &models.ComponentStatusDto{Name: check.name, Ready: true}
+			err := check.check(ctx)
+			if err != nil {
+				component.Ready = false
+				component.Error = err.Error()
+			}
+			readiness.Components[i] = component
+		}(i, check)
+	}
+	wg.Wait()
+	if readiness.Draining {
+		readiness.Ready = false
+	}
+	for _, component := range readiness.Components {
+		if !component.Ready {
+			readiness.Ready = false
+		}
+	}
+	return readiness
+}
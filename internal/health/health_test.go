@@ -0,0 +1,56 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sensord/internal/models"
+	"testing"
+)
+
+func Test_Health_Readiness(t *testing.T) {
+	ctx := context.Background()
+	h := NewHealth()
+	readiness := h.Readiness(ctx)
+	assert.True(t, readiness.Ready)
+	assert.Empty(t, readiness.Components)
+
+	h.AddCheck("db", func(ctx context.Context) error {
+		return nil
+	})
+	h.AddCheck("ingestion", func(ctx context.Context) error {
+		return errors.New("saturated")
+	})
+	readiness = h.Readiness(ctx)
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, []*models.ComponentStatusDto{
+		{Name: "db", Ready: true},
+		{Name: "ingestion", Ready: false, Error: "saturated"},
+	}, readiness.Components)
+}
+
+func Test_Health_Readiness_Draining(t *testing.T) {
+	h := NewHealth()
+	h.AddCheck("db", func(ctx context.Context) error {
+		return nil
+	})
+	h.SetDraining()
+	readiness := h.Readiness(context.Background())
+	assert.False(t, readiness.Ready)
+	assert.True(t, readiness.Draining)
+	assert.True(t, readiness.Components[0].Ready)
+}
+
+func Test_Health_Readiness_Cancelled(t *testing.T) {
+	h := NewHealth()
+	// a hanging check stops when the probe request is cancelled
+	h.AddCheck("db", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	readiness := h.Readiness(ctx)
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, context.Canceled.Error(), readiness.Components[0].Error)
+}
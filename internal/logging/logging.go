@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// LevelCritical the sensord can't work and exits
+const LevelCritical = slog.LevelError + 4
+
+// Level of the default logger. It can be changed at runtime e.g. by the Admin API.
+var Level = &slog.LevelVar{}
+
+// Init sets the default logger that writes JSON lines to the stdout.
+// Records logged with a context get the request id and the trace id of the context.
+// The standard log package e.g. of libraries writes through the same logger.
+func Init(level slog.Level) {
+	Level.Set(level)
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       Level,
+		ReplaceAttr: replaceLevel,
+	})
+	slog.SetDefault(slog.New(&contextHandler{handler}))
+}
+
+// replaceLevel names the LevelCritical instead of the `ERROR+4`
+func replaceLevel(_ []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey {
+		if level, ok := attr.Value.Any().(slog.Level); ok && level >= LevelCritical {
+			attr.Value = slog.StringValue("CRITICAL")
+		}
+	}
+	return attr
+}
+
+// Fatal logs with the LevelCritical and exits
+func Fatal(msg string, args ...any) {
+	slog.Log(context.Background(), LevelCritical, msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds attributes of the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := RequestIdFrom(ctx); requestId != "" {
+		record.AddAttrs(slog.String("request_id", requestId))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIdKey struct{}
+
+// WithRequestId returns a copy of the ctx with the request id
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// RequestIdFrom the ctx or empty if the ctx isn't of a request
+func RequestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// maxRequestIdLen of the X-Request-Id accepted from a caller
+const maxRequestIdLen = 64
+
+var (
+	// requestIdPrefix random for each process so ids of sensord replicas don't collide
+	requestIdPrefix = newRequestIdPrefix()
+	requestCounter  atomic.Uint64
+)
+
+func newRequestIdPrefix() string {
+	var buf [4]byte
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:]) + "-"
+}
+
+// NewRequestId unique within the process. It's cheap enough for each ingested measurement.
+func NewRequestId() string {
+	return requestIdPrefix + strconv.FormatUint(requestCounter.Add(1), 36)
+}
+
+// ValidRequestId checks the caller's X-Request-Id: a short printable ASCII without spaces
+func ValidRequestId(requestId []byte) bool {
+	if len(requestId) == 0 || len(requestId) > maxRequestIdLen {
+		return false
+	}
+	for _, c := range requestId {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"testing"
+)
+
+func Test_contextHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(&contextHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: replaceLevel})})
+	traceId, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanId, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceId, SpanID: spanId}))
+	ctx = WithRequestId(ctx, "req-1")
+
+	logger.With("sensor_id", 1).ErrorContext(ctx, "Unable to store measurement")
+	record := map[string]any{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "ERROR", record["level"])
+	assert.Equal(t, "Unable to store measurement", record["msg"])
+	assert.Equal(t, float64(1), record["sensor_id"])
+	assert.Equal(t, "req-1", record["request_id"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", record["trace_id"])
+
+	// without a request
+	buf.Reset()
+	logger.Log(context.Background(), LevelCritical, "Invalid configuration")
+	record = map[string]any{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "CRITICAL", record["level"])
+	assert.NotContains(t, record, "request_id")
+	assert.NotContains(t, record, "trace_id")
+}
+
+func Test_RequestId(t *testing.T) {
+	assert.NotEqual(t, NewRequestId(), NewRequestId())
+	assert.True(t, ValidRequestId([]byte(NewRequestId())))
+	assert.True(t, ValidRequestId([]byte("f47ac10b-58cc-4372-a567-0e02b2c3d479")))
+	assert.False(t, ValidRequestId(nil))
+	assert.False(t, ValidRequestId([]byte("fake\nlog line")))
+	assert.False(t, ValidRequestId(bytes.Repeat([]byte("a"), maxRequestIdLen+1)))
+	assert.Empty(t, RequestIdFrom(context.Background()))
+}
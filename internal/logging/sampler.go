@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+// Sampler limits logs of each key e.g. of a sensor to the first burst in an interval,
+// so one broken sensor or a DB outage can't flood the logs.
+// The first allowed log of the key in the next interval tells how many were suppressed.
+// Counters are reset each interval so the memory is bounded by keys logged in one interval.
+type Sampler struct {
+	burst    int
+	interval time.Duration
+	mu       sync.Mutex
+	// windowEnd when the counters are reset
+	windowEnd time.Time
+	counts    map[string]int
+	// suppressed in the previous interval and not reported yet
+	suppressed map[string]int
+	now        func() time.Time
+}
+
+func NewSampler(burst int, interval time.Duration) *Sampler {
+	return &Sampler{
+		burst:      burst,
+		interval:   interval,
+		counts:     map[string]int{},
+		suppressed: map[string]int{},
+		now:        time.Now,
+	}
+}
+
+// Allow returns true if the log of the key should be written
+// and the number of the key's logs suppressed in the previous interval.
+func (s *Sampler) Allow(key string) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if !now.Before(s.windowEnd) {
+		s.suppressed = map[string]int{}
+		for k, count := range s.counts {
+			if count > s.burst {
+				s.suppressed[k] = count - s.burst
+			}
+		}
+		s.counts = map[string]int{}
+		s.windowEnd = now.Add(s.interval)
+	}
+	s.counts[key]++
+	if s.counts[key] > s.burst {
+		return false, 0
+	}
+	suppressed := s.suppressed[key]
+	delete(s.suppressed, key)
+	return true, suppressed
+}
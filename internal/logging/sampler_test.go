@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_Sampler_Allow(t *testing.T) {
+	now := time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC)
+	s := NewSampler(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		allowed, suppressed := s.Allow("sensor:1")
+		assert.True(t, allowed)
+		assert.Equal(t, 0, suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		allowed, _ := s.Allow("sensor:1")
+		assert.False(t, allowed)
+	}
+	// other sensors are not affected
+	allowed, _ := s.Allow("sensor:2")
+	assert.True(t, allowed)
+
+	// the next interval tells how many were suppressed once
+	now = now.Add(time.Minute)
+	allowed, suppressed := s.Allow("sensor:1")
+	assert.True(t, allowed)
+	assert.Equal(t, 3, suppressed)
+	allowed, suppressed = s.Allow("sensor:1")
+	assert.True(t, allowed)
+	assert.Equal(t, 0, suppressed)
+	allowed, suppressed = s.Allow("sensor:2")
+	assert.True(t, allowed)
+	assert.Equal(t, 0, suppressed)
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Registry of the sensord metrics. Labels have a bounded set of values: there are no per-sensor labels.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var factory = promauto.With(Registry)
+
+var (
+	MeasurementsAccepted = factory.NewCounter(prometheus.CounterOpts{
+		Name: "sensord_measurements_accepted_total",
+		Help: "Measurements stored into the daily aggregates.",
+	})
+	MeasurementsRejected = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "sensord_measurements_rejected_total",
+		Help: "Rejected measurements or requests by the reason: a validation rule, unauthorized, rate_limited etc.",
+	}, []string{"reason"})
+	DbQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sensord_db_query_duration_seconds",
+		Help:    "Latency of DB queries.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"query"})
+	HttpRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "sensord_http_requests_total",
+		Help: "HTTP requests by the server, the handler and the status code.",
+	}, []string{"server", "handler", "code"})
+)
+
+// Reasons of rejected measurements besides validation rules
+const (
+	ReasonUnsupportedMedia = "unsupported_media_type"
+	ReasonTooLarge         = "too_large"
+	ReasonUnauthorized     = "unauthorized"
+	ReasonForbidden        = "forbidden"
+	ReasonRateLimited      = "rate_limited"
+	ReasonStorageError     = "storage_error"
+)
+
+// HandlerOther the label of unknown URL paths so scanners don't add new series
+const HandlerOther = "other"
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveQuery records the latency of the query started at the start e.g. defer metrics.ObserveQuery("store_measurement", time.Now())
+func ObserveQuery(query string, start time.Time) {
+	DbQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// statusCodes label values of all HTTP statuses to not format them on each request
+var statusCodes [600]string
+
+func init() {
+	for code := range statusCodes {
+		statusCodes[code] = strconv.Itoa(code)
+	}
+}
+
+// CountRequest increments the requests counter of the handler
+func CountRequest(server string, handler string, code int) {
+	codeLabel := HandlerOther
+	if code >= 0 && code < len(statusCodes) {
+		codeLabel = statusCodes[code]
+	}
+	HttpRequests.WithLabelValues(server, handler, codeLabel).Inc()
+}
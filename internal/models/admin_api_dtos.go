@@ -9,12 +9,120 @@ type MeasurementRec struct {
 	// PeriodEnd when the stats period ends. Exclusive
 	PeriodEnd  time.Time
 	SensorId   int
+	Metric     string
 	TotalCount int64
 	TotalSum   float64
-	// Average temperature
+	// Average value
 	AvgValue float64
-	// Minimal temperature
+	// Minimal value
 	MinValue float64
-	// Maximum temperature
+	// Maximum value
 	MaxValue float64
+	// Variance population variance of values or nil for days stored before the variance was tracked
+	Variance *float64
+	// Unit of the values
+	Unit string
+	// LateCount measurements that arrived after the lateness horizon
+	LateCount int64
+	// ServerTimeCount measurements stamped with the server receive time
+	ServerTimeCount int64
+}
+
+// StatsFilter narrows down the stats reports
+type StatsFilter struct {
+	// SensorIds include only the sensors. Nil means all sensors
+	SensorIds []int
+	// Metric include only the metric. Empty means all metrics
+	Metric string
+}
+
+// Role of an admin user
+type Role string
+
+const (
+	// RoleViewer can see reports
+	RoleViewer Role = "viewer"
+	// RoleOperator can also delete measurements
+	RoleOperator Role = "operator"
+	// RoleAdmin can also manage users and settings
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// IsValid returns true for a known role
+func (r Role) IsValid() bool {
+	_, found := roleLevels[r]
+	return found
+}
+
+// Allows returns true if the role has permissions of the required role
+func (r Role) Allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+// AdminUser of the Admin API
+type AdminUser struct {
+	Username     string
+	PasswordHash string `json:"-"`
+	Role         Role
+	// SensorIds the user can see. Nil means all sensors
+	SensorIds []int
+}
+
+// CanSeeSensor returns true if the user isn't scoped or the sensor is in the user's scope
+func (u *AdminUser) CanSeeSensor(sensorId int) bool {
+	if u.SensorIds == nil {
+		return true
+	}
+	for _, id := range u.SensorIds {
+		if id == sensorId {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSeeSensors returns true if the user can see all the sensors. Nil sensorIds means all sensors.
+func (u *AdminUser) CanSeeSensors(sensorIds []int) bool {
+	if u.SensorIds == nil {
+		return true
+	}
+	if sensorIds == nil {
+		return false
+	}
+	for _, sensorId := range sensorIds {
+		if !u.CanSeeSensor(sensorId) {
+			return false
+		}
+	}
+	return true
+}
+
+// AdminUserDto used to create or update an admin user
+type AdminUserDto struct {
+	Username string
+	// Password plain text. If empty on update then the old password is kept
+	Password  string
+	Role      Role
+	SensorIds []int
+}
+
+// LogLevelDto the minimal level of logs e.g. `DEBUG`, `INFO`, `WARN` or `ERROR`
+type LogLevelDto struct {
+	Level string
+}
+
+// ConfigReloadDto result of a config reload
+type ConfigReloadDto struct {
+	// Applied settings now have the new values
+	Applied []string
+	// RestartRequired settings are changed in the config but keep the old values until a restart
+	RestartRequired []string
+	// Error why the new config was rejected. Nothing is changed then.
+	Error string `json:",omitempty"`
 }
@@ -0,0 +1,17 @@
+package models
+
+// ReadinessDto a response of the /readyz
+type ReadinessDto struct {
+	Ready bool `json:"ready"`
+	// Draining the sensord is shutting down
+	Draining   bool                  `json:"draining"`
+	Components []*ComponentStatusDto `json:"components"`
+}
+
+// ComponentStatusDto readiness of a component e.g. the DB
+type ComponentStatusDto struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	// Error why the component is not ready. It's logged but not served because it may reveal e.g. the DB host and user.
+	Error string `json:"-"`
+}
@@ -7,4 +7,63 @@ type MeasurementDto struct {
 	SensorId int       `json:"sensorId"`
 	Time     time.Time `json:"time"`
 	Value    float64   `json:"value"`
+	// Metric type of the measurement. Optional, the DefaultMetric if empty
+	Metric string `json:"metric,omitempty"`
+	// Unit of the value e.g. fahrenheit. Optional, the sensor's default unit or the metric's unit if empty
+	Unit string `json:"unit,omitempty"`
+	// MeasurementId optional unique id of the measurement generated by the sensor to de-duplicate retries
+	MeasurementId string `json:"measurementId,omitempty"`
+	// Flags are set by the server e.g. if the measurement is late
+	Flags MeasurementFlags `json:"-"`
+}
+
+// MeasurementFlags how the measurement was received
+type MeasurementFlags uint8
+
+const (
+	// FlagLate the measurement is older than the lateness horizon
+	FlagLate MeasurementFlags = 1 << iota
+	// FlagServerTime the measurement is stamped with the server receive time instead of the sensor time
+	FlagServerTime
+)
+
+// Has returns true if the flag is set
+func (f MeasurementFlags) Has(flag MeasurementFlags) bool {
+	return f&flag != 0
+}
+
+// DefaultMetric is used when a sensor doesn't send a metric
+const DefaultMetric = "temperature"
+
+// MetricUnits known metrics and units of their values
+var MetricUnits = map[string]string{
+	"temperature": "celsius",
+	"humidity":    "percent",
+	"co2":         "ppm",
+	"pressure":    "hpa",
+}
+
+// ErrorDto a response to a rejected measurement
+type ErrorDto struct {
+	// Rule which failed e.g. `value_range`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// BatchResultDto a response to a batch of measurements
+type BatchResultDto struct {
+	// Accepted number of stored measurements including skipped retries
+	Accepted int `json:"accepted"`
+	// Rejected measurements that weren't stored
+	Rejected []*RejectedDto `json:"rejected,omitempty"`
+}
+
+// RejectedDto a measurement of a batch that wasn't stored
+type RejectedDto struct {
+	// Index of the measurement in the batch
+	Index int `json:"index"`
+	// Status an HTTP status that the measurement would get if sent alone e.g. 400 or 429
+	Status  int    `json:"status"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message,omitempty"`
 }
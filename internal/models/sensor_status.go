@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// SensorStatus what sensord knows about a sensor since start
+type SensorStatus struct {
+	SensorId int
+	// LastSeen server time of the last measurement
+	LastSeen time.Time
+	// MeasurementCount received measurements
+	MeasurementCount int64
+	// LateCount measurements older than the lateness horizon
+	LateCount int64
+	// ServerTimeCount measurements stamped with the server receive time
+	ServerTimeCount int64
+	// ClockOffsetMs estimated difference between the server and the sensor clocks in milliseconds.
+	// Positive if the sensor clock is behind. Includes a network delay.
+	ClockOffsetMs int64
+	// LastValues the latest value of each metric in the metric's unit
+	LastValues map[string]float64
+}
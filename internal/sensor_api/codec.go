@@ -0,0 +1,287 @@
+package sensor_api
+
+import (
+	"bytes"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sensord/internal/models"
+	"time"
+)
+
+// payloadFormat decodes measurements sent with a specific Content-Type.
+// In the strict mode unknown fields are rejected.
+type payloadFormat struct {
+	name        string
+	decode      func(body []byte, measurement *models.MeasurementDto, strict bool) error
+	decodeBatch func(body []byte, strict bool) ([]*models.MeasurementDto, error)
+}
+
+var (
+	jsonFormat     = &payloadFormat{"json", decodeJson, decodeJsonBatch}
+	cborFormat     = &payloadFormat{"cbor", decodeCbor, decodeCborBatch}
+	msgpackFormat  = &payloadFormat{"msgpack", decodeMsgpack, decodeMsgpackBatch}
+	protobufFormat = &payloadFormat{"protobuf", decodeProtobuf, decodeProtobufBatch}
+)
+
+// payloadFormats by the media type of the Content-Type
+var payloadFormats = map[string]*payloadFormat{
+	"application/json":                jsonFormat,
+	"application/cbor":                cborFormat,
+	"application/msgpack":             msgpackFormat,
+	"application/x-msgpack":           msgpackFormat,
+	"application/vnd.msgpack":         msgpackFormat,
+	"application/protobuf":            protobufFormat,
+	"application/x-protobuf":          protobufFormat,
+	"application/vnd.google.protobuf": protobufFormat,
+}
+
+// payloadFormatOf returns the format of the Content-Type or nil if it's not supported.
+// Without the Content-Type the body is a JSON as sensors always sent it.
+func payloadFormatOf(contentType []byte) *payloadFormat {
+	// strip parameters e.g. `;charset=utf-8`
+	if i := bytes.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = bytes.TrimSpace(contentType)
+	if len(contentType) == 0 {
+		return jsonFormat
+	}
+	// the map lookup with the string conversion doesn't allocate
+	format := payloadFormats[string(contentType)]
+	if format == nil {
+		format = payloadFormats[string(bytes.ToLower(contentType))]
+	}
+	return format
+}
+
+var (
+	cborDefaultDecMode, _ = cbor.DecOptions{}.DecMode()
+	// cborStrictDecMode rejects unknown fields
+	cborStrictDecMode, _ = cbor.DecOptions{
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	}.DecMode()
+)
+
+func cborDecMode(strict bool) cbor.DecMode {
+	if strict {
+		return cborStrictDecMode
+	}
+	return cborDefaultDecMode
+}
+
+// decodeCbor decodes a map with the same keys as the JSON.
+// The time is an RFC3339 string or a Unix time number with or without the tag.
+func decodeCbor(body []byte, measurement *models.MeasurementDto, strict bool) error {
+	err := cborDecMode(strict).Unmarshal(body, measurement)
+	if err != nil {
+		return err
+	}
+	measurement.Time = utcTime(measurement.Time)
+	return nil
+}
+
+func decodeCborBatch(body []byte, strict bool) ([]*models.MeasurementDto, error) {
+	var measurements []*models.MeasurementDto
+	err := cborDecMode(strict).Unmarshal(body, &measurements)
+	if err != nil {
+		return nil, err
+	}
+	for _, measurement := range measurements {
+		if measurement != nil {
+			measurement.Time = utcTime(measurement.Time)
+		}
+	}
+	return measurements, nil
+}
+
+// decodeMsgpack decodes a map with the same keys as the JSON.
+// The time is a timestamp extension or an RFC3339 string.
+func decodeMsgpack(body []byte, measurement *models.MeasurementDto, strict bool) error {
+	err := unmarshalMsgpack(body, measurement, strict)
+	if err != nil {
+		return err
+	}
+	measurement.Time = utcTime(measurement.Time)
+	return nil
+}
+
+func decodeMsgpackBatch(body []byte, strict bool) ([]*models.MeasurementDto, error) {
+	var measurements []*models.MeasurementDto
+	err := unmarshalMsgpack(body, &measurements, strict)
+	if err != nil {
+		return nil, err
+	}
+	for _, measurement := range measurements {
+		if measurement != nil {
+			measurement.Time = utcTime(measurement.Time)
+		}
+	}
+	return measurements, nil
+}
+
+func unmarshalMsgpack(body []byte, v any, strict bool) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+	dec.Reset(bytes.NewReader(body))
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(strict)
+	return dec.Decode(v)
+}
+
+// Field numbers of the api/measurement.proto
+const (
+	protoMeasurementSensorId      protowire.Number = 1
+	protoMeasurementTime          protowire.Number = 2
+	protoMeasurementValue         protowire.Number = 3
+	protoMeasurementMetric        protowire.Number = 4
+	protoMeasurementUnit          protowire.Number = 5
+	protoMeasurementMeasurementId protowire.Number = 6
+
+	protoBatchMeasurements protowire.Number = 1
+
+	protoTimestampSeconds protowire.Number = 1
+	protoTimestampNanos   protowire.Number = 2
+)
+
+var errProtoWireType = errors.New("unexpected wire type")
+
+// decodeProtobuf decodes the `Measurement` message.
+// The message is small and flat so it's decoded directly from the wire format without a generated code and reflection.
+// Unknown fields are always skipped because that is how a Protobuf schema evolves.
+func decodeProtobuf(body []byte, measurement *models.MeasurementDto, _ bool) error {
+	return decodeProtoMeasurement(body, measurement)
+}
+
+// decodeProtobufBatch decodes the `MeasurementBatch` message
+func decodeProtobufBatch(body []byte, _ bool) ([]*models.MeasurementDto, error) {
+	var measurements []*models.MeasurementDto
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+		if num != protoBatchMeasurements {
+			n = protowire.ConsumeFieldValue(num, typ, body)
+		} else if typ != protowire.BytesType {
+			return nil, errProtoWireType
+		} else {
+			var msg []byte
+			msg, n = protowire.ConsumeBytes(body)
+			if n >= 0 {
+				measurement := &models.MeasurementDto{}
+				err := decodeProtoMeasurement(msg, measurement)
+				if err != nil {
+					return nil, err
+				}
+				measurements = append(measurements, measurement)
+			}
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+	}
+	return measurements, nil
+}
+
+func decodeProtoMeasurement(msg []byte, measurement *models.MeasurementDto) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch num {
+		case protoMeasurementSensorId:
+			if typ != protowire.VarintType {
+				return errProtoWireType
+			}
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			measurement.SensorId = int(int32(v))
+		case protoMeasurementTime:
+			if typ != protowire.BytesType {
+				return errProtoWireType
+			}
+			var timestamp []byte
+			timestamp, n = protowire.ConsumeBytes(msg)
+			if n >= 0 {
+				var err error
+				measurement.Time, err = decodeProtoTimestamp(timestamp)
+				if err != nil {
+					return err
+				}
+			}
+		case protoMeasurementValue:
+			if typ != protowire.Fixed64Type {
+				return errProtoWireType
+			}
+			var v uint64
+			v, n = protowire.ConsumeFixed64(msg)
+			measurement.Value = math.Float64frombits(v)
+		case protoMeasurementMetric, protoMeasurementUnit, protoMeasurementMeasurementId:
+			if typ != protowire.BytesType {
+				return errProtoWireType
+			}
+			var v []byte
+			v, n = protowire.ConsumeBytes(msg)
+			switch num {
+			case protoMeasurementMetric:
+				measurement.Metric = string(v)
+			case protoMeasurementUnit:
+				measurement.Unit = string(v)
+			default:
+				measurement.MeasurementId = string(v)
+			}
+		default:
+			// skip unknown fields of a newer schema
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// decodeProtoTimestamp decodes the google.protobuf.Timestamp
+func decodeProtoTimestamp(msg []byte) (time.Time, error) {
+	var seconds, nanos int64
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if (num == protoTimestampSeconds || num == protoTimestampNanos) && typ == protowire.VarintType {
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			if num == protoTimestampSeconds {
+				seconds = int64(v)
+			} else {
+				nanos = int64(int32(v))
+			}
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+// utcTime converts a Unix time that was decoded in the server's local time zone to UTC
+// so the measurement day doesn't depend on the server's time zone
+func utcTime(t time.Time) time.Time {
+	if t.Location() == time.Local {
+		return t.UTC()
+	}
+	return t
+}
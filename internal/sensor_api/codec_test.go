@@ -0,0 +1,209 @@
+package sensor_api
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sensord/internal/models"
+	"testing"
+	"time"
+)
+
+var codecTime = time.Date(2023, 10, 3, 12, 30, 0, 500*int(time.Millisecond), time.UTC)
+
+var expectedMeasurement = &models.MeasurementDto{
+	SensorId:      1,
+	Time:          codecTime,
+	Value:         21.5,
+	Metric:        "humidity",
+	Unit:          "percent",
+	MeasurementId: "m1",
+}
+
+var jsonBody = []byte(`{"sensorId":1,"time":"2023-10-03T12:30:00.5Z","value":21.5,"metric":"humidity","unit":"percent","measurementId":"m1"}`)
+
+// codecMap the same keys as the JSON
+func codecMap() map[string]any {
+	return map[string]any{
+		"sensorId":      1,
+		"time":          codecTime,
+		"value":         21.5,
+		"metric":        "humidity",
+		"unit":          "percent",
+		"measurementId": "m1",
+	}
+}
+
+// cborEncMode encodes the time as a Unix time with the fraction of a second like sensors do
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeUnixDynamic, TimeTag: cbor.EncTagRequired}.EncMode()
+
+func cborBody() []byte {
+	body, _ := cborEncMode.Marshal(codecMap())
+	return body
+}
+
+func msgpackBody() []byte {
+	body, _ := msgpack.Marshal(codecMap())
+	return body
+}
+
+func protoMeasurement(m *models.MeasurementDto) []byte {
+	var timestamp []byte
+	timestamp = protowire.AppendTag(timestamp, protoTimestampSeconds, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(m.Time.Unix()))
+	timestamp = protowire.AppendTag(timestamp, protoTimestampNanos, protowire.VarintType)
+	timestamp = protowire.AppendVarint(timestamp, uint64(m.Time.Nanosecond()))
+
+	var msg []byte
+	msg = protowire.AppendTag(msg, protoMeasurementSensorId, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(m.SensorId))
+	msg = protowire.AppendTag(msg, protoMeasurementTime, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, timestamp)
+	msg = protowire.AppendTag(msg, protoMeasurementValue, protowire.Fixed64Type)
+	msg = protowire.AppendFixed64(msg, math.Float64bits(m.Value))
+	msg = protowire.AppendTag(msg, protoMeasurementMetric, protowire.BytesType)
+	msg = protowire.AppendString(msg, m.Metric)
+	msg = protowire.AppendTag(msg, protoMeasurementUnit, protowire.BytesType)
+	msg = protowire.AppendString(msg, m.Unit)
+	msg = protowire.AppendTag(msg, protoMeasurementMeasurementId, protowire.BytesType)
+	msg = protowire.AppendString(msg, m.MeasurementId)
+	return msg
+}
+
+func protoBatch(measurements ...*models.MeasurementDto) []byte {
+	var msg []byte
+	for _, m := range measurements {
+		msg = protowire.AppendTag(msg, protoBatchMeasurements, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, protoMeasurement(m))
+	}
+	return msg
+}
+
+func Test_payloadFormatOf(t *testing.T) {
+	assert.Equal(t, jsonFormat, payloadFormatOf(nil))
+	assert.Equal(t, jsonFormat, payloadFormatOf([]byte("application/json;charset=utf-8")))
+	assert.Equal(t, cborFormat, payloadFormatOf([]byte("application/cbor")))
+	assert.Equal(t, msgpackFormat, payloadFormatOf([]byte("application/x-msgpack")))
+	assert.Equal(t, protobufFormat, payloadFormatOf([]byte("Application/Protobuf")))
+	assert.Nil(t, payloadFormatOf([]byte("text/plain")))
+}
+
+func Test_decode(t *testing.T) {
+	bodies := map[*payloadFormat][]byte{
+		jsonFormat:     jsonBody,
+		cborFormat:     cborBody(),
+		msgpackFormat:  msgpackBody(),
+		protobufFormat: protoMeasurement(expectedMeasurement),
+	}
+	for format, body := range bodies {
+		t.Run(format.name, func(t *testing.T) {
+			measurement := &models.MeasurementDto{}
+			err := format.decode(body, measurement, true)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedMeasurement, measurement)
+		})
+	}
+}
+
+func Test_decodeBatch(t *testing.T) {
+	second := &models.MeasurementDto{SensorId: 2, Time: codecTime, Value: -1}
+	secondMap := map[string]any{"sensorId": 2, "time": codecTime, "value": -1}
+	cborBatch, _ := cborEncMode.Marshal([]any{codecMap(), secondMap})
+	msgpackBatch, _ := msgpack.Marshal([]any{codecMap(), secondMap})
+	bodies := map[*payloadFormat][]byte{
+		jsonFormat:     []byte(`[` + string(jsonBody) + `,{"sensorId":2,"time":"2023-10-03T12:30:00.5Z","value":-1}]`),
+		cborFormat:     cborBatch,
+		msgpackFormat:  msgpackBatch,
+		protobufFormat: protoBatch(expectedMeasurement, second),
+	}
+	for format, body := range bodies {
+		t.Run(format.name, func(t *testing.T) {
+			measurements, err := format.decodeBatch(body, true)
+			assert.NoError(t, err)
+			assert.Equal(t, []*models.MeasurementDto{expectedMeasurement, second}, measurements)
+		})
+	}
+}
+
+func Test_decode_UnixTime(t *testing.T) {
+	// constrained sensors may send the time as a number of seconds
+	body, _ := cbor.Marshal(map[string]any{"sensorId": 1, "time": 1696336200, "value": 20})
+	measurement := &models.MeasurementDto{}
+	err := decodeCbor(body, measurement, false)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 10, 3, 12, 30, 0, 0, time.UTC), measurement.Time)
+
+	// without the time
+	measurement = &models.MeasurementDto{}
+	err = decodeProtobuf(protowire.AppendVarint(protowire.AppendTag(nil, protoMeasurementSensorId, protowire.VarintType), 1), measurement, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, measurement.SensorId)
+	assert.True(t, measurement.Time.IsZero())
+}
+
+func Test_decodeProtobuf_Malformed(t *testing.T) {
+	body := protoMeasurement(expectedMeasurement)
+	err := decodeProtobuf(body[:len(body)-1], &models.MeasurementDto{}, false)
+	assert.Error(t, err)
+
+	// the sensorId as a string
+	wrongType := protowire.AppendString(protowire.AppendTag(nil, protoMeasurementSensorId, protowire.BytesType), "1")
+	err = decodeProtobuf(wrongType, &models.MeasurementDto{}, false)
+	assert.ErrorIs(t, err, errProtoWireType)
+
+	// unknown fields are skipped
+	unknown := protowire.AppendVarint(protowire.AppendTag(body, 100, protowire.VarintType), 42)
+	measurement := &models.MeasurementDto{}
+	err = decodeProtobuf(unknown, measurement, true)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedMeasurement, measurement)
+}
+
+func benchmarkDecode(b *testing.B, format *payloadFormat, body []byte) {
+	measurement := &models.MeasurementDto{}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		*measurement = models.MeasurementDto{}
+		err := format.decode(body, measurement, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_decodeJson(b *testing.B) {
+	benchmarkDecode(b, jsonFormat, jsonBody)
+}
+
+func Benchmark_decodeCbor(b *testing.B) {
+	benchmarkDecode(b, cborFormat, cborBody())
+}
+
+func Benchmark_decodeMsgpack(b *testing.B) {
+	benchmarkDecode(b, msgpackFormat, msgpackBody())
+}
+
+func Benchmark_decodeProtobuf(b *testing.B) {
+	benchmarkDecode(b, protobufFormat, protoMeasurement(expectedMeasurement))
+}
+
+func Test_decode_Strict(t *testing.T) {
+	withUnknown := map[string]any{"sensorId": 1, "value": 20, "humidity": 40}
+	cborUnknown, _ := cbor.Marshal(withUnknown)
+	msgpackUnknown, _ := msgpack.Marshal(withUnknown)
+	bodies := map[*payloadFormat][]byte{
+		jsonFormat:    []byte(`{"sensorId":1,"value":20,"humidity":40}`),
+		cborFormat:    cborUnknown,
+		msgpackFormat: msgpackUnknown,
+	}
+	for format, body := range bodies {
+		t.Run(format.name, func(t *testing.T) {
+			assert.NoError(t, format.decode(body, &models.MeasurementDto{}, false))
+			assert.Error(t, format.decode(body, &models.MeasurementDto{}, true))
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package sensor_api
+
+import (
+	"bytes"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// supportedEncodings is sent in the Accept-Encoding of the 415 response
+const supportedEncodings = "gzip, deflate, br, zstd"
+
+// zstdMaxWindow the default window of zstd compressors
+const zstdMaxWindow = 8 << 20
+
+var (
+	contentEncodingHeader      = []byte("Content-Encoding")
+	contentEncodingHeaderLower = []byte("content-encoding")
+)
+
+var (
+	ErrEncodingUnsupported = errors.New("content encoding is not supported")
+	ErrBodyTooLarge        = errors.New("decompressed body is too large")
+)
+
+// decompressor decompresses request bodies with a limit of the decompressed size to stop decompression bombs.
+// Readers are reused because they have big internal buffers.
+type decompressor struct {
+	maxSize       int
+	gzipReaders   sync.Pool
+	zlibReaders   sync.Pool
+	flateReaders  sync.Pool
+	brotliReaders sync.Pool
+	zstdReaders   sync.Pool
+}
+
+func newDecompressor(maxSize int) *decompressor {
+	return &decompressor{maxSize: maxSize}
+}
+
+// bufferPool of decompressed bodies
+var bufferPool = sync.Pool{
+	New: func() any {
+		return &bytes.Buffer{}
+	},
+}
+
+// decompress the body with the Content-Encoding into the buf.
+// Returns the body itself if it's not compressed.
+func (d *decompressor) decompress(encoding []byte, body []byte, buf *bytes.Buffer) ([]byte, error) {
+	encoding = bytes.TrimSpace(encoding)
+	if len(encoding) == 0 || equalFold(encoding, "identity") {
+		return body, nil
+	}
+	var err error
+	switch {
+	case equalFold(encoding, "gzip") || equalFold(encoding, "x-gzip"):
+		err = d.gunzip(body, buf)
+	case equalFold(encoding, "deflate"):
+		err = d.inflate(body, buf)
+	case equalFold(encoding, "br"):
+		err = d.unbrotli(body, buf)
+	case equalFold(encoding, "zstd"):
+		err = d.unzstd(body, buf)
+	default:
+		// including a chain of encodings e.g. `gzip, br`
+		return nil, ErrEncodingUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *decompressor) gunzip(body []byte, buf *bytes.Buffer) error {
+	var reader *gzip.Reader
+	var err error
+	if pooled := d.gzipReaders.Get(); pooled != nil {
+		reader = pooled.(*gzip.Reader)
+		err = reader.Reset(bytes.NewReader(body))
+	} else {
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return err
+	}
+	defer d.gzipReaders.Put(reader)
+	return d.readLimited(reader, buf)
+}
+
+// inflate the `deflate` encoding. By the RFC 9110 it's a zlib stream but some clients send a raw deflate.
+func (d *decompressor) inflate(body []byte, buf *bytes.Buffer) error {
+	if !isZlibHeader(body) {
+		reader := d.flateReaders.Get()
+		if reader == nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			_ = reader.(flate.Resetter).Reset(bytes.NewReader(body), nil)
+		}
+		defer d.flateReaders.Put(reader)
+		return d.readLimited(reader.(io.Reader), buf)
+	}
+	var reader io.ReadCloser
+	var err error
+	if pooled := d.zlibReaders.Get(); pooled != nil {
+		reader = pooled.(io.ReadCloser)
+		err = reader.(zlib.Resetter).Reset(bytes.NewReader(body), nil)
+	} else {
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return err
+	}
+	defer d.zlibReaders.Put(reader)
+	return d.readLimited(reader, buf)
+}
+
+// isZlibHeader checks the compression method and the header checksum of the RFC 1950
+func isZlibHeader(body []byte) bool {
+	return len(body) >= 2 && body[0]&0x0f == 8 && (uint16(body[0])<<8|uint16(body[1]))%31 == 0
+}
+
+func (d *decompressor) unbrotli(body []byte, buf *bytes.Buffer) error {
+	var reader *brotli.Reader
+	if pooled := d.brotliReaders.Get(); pooled != nil {
+		reader = pooled.(*brotli.Reader)
+		_ = reader.Reset(bytes.NewReader(body))
+	} else {
+		reader = brotli.NewReader(bytes.NewReader(body))
+	}
+	defer d.brotliReaders.Put(reader)
+	return d.readLimited(reader, buf)
+}
+
+func (d *decompressor) unzstd(body []byte, buf *bytes.Buffer) error {
+	var reader *zstd.Decoder
+	var err error
+	if pooled := d.zstdReaders.Get(); pooled != nil {
+		reader = pooled.(*zstd.Decoder)
+		err = reader.Reset(bytes.NewReader(body))
+	} else {
+		// decode synchronously without goroutines and don't allocate a huge window of a malicious frame
+		reader, err = zstd.NewReader(bytes.NewReader(body),
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdMaxWindow),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	defer d.zstdReaders.Put(reader)
+	err = d.readLimited(reader, buf)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return ErrBodyTooLarge
+	}
+	return err
+}
+
+// readLimited reads at most maxSize bytes and fails without reading the rest of a bomb
+func (d *decompressor) readLimited(reader io.Reader, buf *bytes.Buffer) error {
+	n, err := buf.ReadFrom(io.LimitReader(reader, int64(d.maxSize)+1))
+	if err != nil {
+		return err
+	}
+	if n > int64(d.maxSize) {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package sensor_api
+
+import (
+	"bytes"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func compress(encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buf)
+	case "deflate":
+		writer = zlib.NewWriter(&buf)
+	case "raw deflate":
+		writer, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		writer = brotli.NewWriter(&buf)
+	case "zstd":
+		writer, _ = zstd.NewWriter(&buf)
+	}
+	_, _ = writer.Write(data)
+	_ = writer.Close()
+	return buf.Bytes()
+}
+
+func Test_decompressor_decompress(t *testing.T) {
+	d := newDecompressor(1000)
+	encodings := map[string]string{
+		"gzip":        "gzip",
+		"deflate":     "deflate",
+		"raw deflate": "deflate",
+		"br":          "br",
+		"zstd":        "zstd",
+	}
+	for compression, encoding := range encodings {
+		t.Run(compression, func(t *testing.T) {
+			compressed := compress(compression, signedBody)
+			// twice to reuse the pooled reader
+			for i := 0; i < 2; i++ {
+				body, err := d.decompress([]byte(encoding), compressed, &bytes.Buffer{})
+				assert.NoError(t, err)
+				assert.Equal(t, signedBody, body)
+			}
+		})
+	}
+
+	// not compressed
+	body, err := d.decompress(nil, signedBody, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, signedBody, body)
+	body, err = d.decompress([]byte("identity"), signedBody, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, signedBody, body)
+
+	// case-insensitive
+	body, err = d.decompress([]byte("GZIP"), compress("gzip", signedBody), &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.Equal(t, signedBody, body)
+}
+
+func Test_decompressor_decompress_Errors(t *testing.T) {
+	d := newDecompressor(1000)
+
+	_, err := d.decompress([]byte("compress"), signedBody, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrEncodingUnsupported)
+	_, err = d.decompress([]byte("gzip, br"), signedBody, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrEncodingUnsupported)
+
+	// the body is not compressed
+	_, err = d.decompress([]byte("gzip"), signedBody, &bytes.Buffer{})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrBodyTooLarge)
+
+	// a bomb: a megabyte of zeros is compressed to a few bytes
+	bomb := make([]byte, 1<<20)
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			_, err := d.decompress([]byte(encoding), compress(encoding, bomb), buf)
+			assert.ErrorIs(t, err, ErrBodyTooLarge)
+			assert.LessOrEqual(t, buf.Len(), 1001)
+		})
+	}
+}
+
+func Benchmark_decompressor_decompress(b *testing.B) {
+	d := newDecompressor(1 << 20)
+	compressed := compress("gzip", signedBody)
+	buf := &bytes.Buffer{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		_, err := d.decompress([]byte("gzip"), compressed, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
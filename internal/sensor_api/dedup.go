@@ -0,0 +1,139 @@
+package sensor_api
+
+import (
+	"context"
+	"expvar"
+	"sensord/internal/models"
+	"sync"
+	"time"
+)
+
+// duplicatesTotal counts measurements that were skipped as retries
+var duplicatesTotal = expvar.NewInt("sensord_duplicates_total")
+
+// dedupKey identifies a measurement: by the client's measurementId or by the sensor's time
+type dedupKey struct {
+	sensorId      int
+	metric        string
+	measurementId string
+	time          int64
+}
+
+// noDedupKey of a measurement that can't be told from its retry so it's never skipped
+var noDedupKey = dedupKey{}
+
+// dedupKeyOf the measurement before it's validated.
+// A measurement stamped with the server time has no time of its own, so without a measurementId
+// each one is a new reading and gets the noDedupKey.
+func dedupKeyOf(measurement *models.MeasurementDto, serverTime bool) dedupKey {
+	if measurement.MeasurementId != "" {
+		return dedupKey{sensorId: measurement.SensorId, measurementId: measurement.MeasurementId}
+	}
+	if serverTime {
+		return noDedupKey
+	}
+	return dedupKey{sensorId: measurement.SensorId, metric: measurement.Metric, time: measurement.Time.UnixNano()}
+}
+
+type dedupEntry struct {
+	key     dedupKey
+	expires time.Time
+}
+
+// deduplicator remembers recent stored measurements inside a window to skip retries.
+// The memory is bounded: when there are maxEntries then the oldest one is forgotten before its window ends.
+type deduplicator struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	expires map[dedupKey]time.Time
+	// inFlight measurements that are being stored. A retry waits until the channel is closed.
+	inFlight map[dedupKey]chan struct{}
+	// queue of entries in insertion order. A ring buffer with a capacity of maxEntries
+	queue []dedupEntry
+	head  int
+	size  int
+}
+
+// newDeduplicator creates a deduplicator or returns nil if the de-duplication is disabled
+func newDeduplicator(window time.Duration, maxEntries int) *deduplicator {
+	if window <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &deduplicator{
+		window:   window,
+		now:      time.Now,
+		expires:  make(map[dedupKey]time.Time),
+		inFlight: make(map[dedupKey]chan struct{}),
+		queue:    make([]dedupEntry, maxEntries),
+	}
+}
+
+// isDuplicate returns true if the measurement was already stored inside the window.
+// Otherwise, the caller stores it and must call the done with the result.
+// A concurrent retry waits for the result so it's neither counted twice nor lost if the store fails.
+func (d *deduplicator) isDuplicate(ctx context.Context, key dedupKey) (bool, error) {
+	if d == nil || key == noDedupKey {
+		return false, nil
+	}
+	for {
+		now := d.now()
+		d.mu.Lock()
+		d.evictExpired(now)
+		if expires, found := d.expires[key]; found && now.Before(expires) {
+			d.mu.Unlock()
+			duplicatesTotal.Add(1)
+			return true, nil
+		}
+		storing, found := d.inFlight[key]
+		if !found {
+			d.inFlight[key] = make(chan struct{})
+			d.mu.Unlock()
+			return false, nil
+		}
+		d.mu.Unlock()
+		select {
+		case <-storing:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// done remembers the stored measurement. A measurement that wasn't stored is not remembered so its retry is accepted.
+func (d *deduplicator) done(key dedupKey, stored bool) {
+	if d == nil || key == noDedupKey {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if stored {
+		if d.size == len(d.queue) {
+			d.evictOldest()
+		}
+		expires := d.now().Add(d.window)
+		d.expires[key] = expires
+		d.queue[(d.head+d.size)%len(d.queue)] = dedupEntry{key, expires}
+		d.size++
+	}
+	close(d.inFlight[key])
+	delete(d.inFlight, key)
+}
+
+func (d *deduplicator) evictExpired(now time.Time) {
+	for d.size > 0 && !now.Before(d.queue[d.head].expires) {
+		d.evictOldest()
+	}
+}
+
+func (d *deduplicator) evictOldest() {
+	entry := d.queue[d.head]
+	// the key may be re-added later with a new expiration
+	if expires, found := d.expires[entry.key]; found && expires.Equal(entry.expires) {
+		delete(d.expires, entry.key)
+	}
+	d.queue[d.head] = dedupEntry{}
+	d.head = (d.head + 1) % len(d.queue)
+	d.size--
+}
@@ -0,0 +1,136 @@
+package sensor_api
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sensord/internal/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// seen checks the measurement and remembers it as stored
+func seen(d *deduplicator, key dedupKey) bool {
+	duplicate, _ := d.isDuplicate(context.Background(), key)
+	if !duplicate {
+		d.done(key, true)
+	}
+	return duplicate
+}
+
+func Test_deduplicator_isDuplicate(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	d := newDeduplicator(time.Minute, 10)
+	d.now = func() time.Time { return now }
+
+	measurement := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: now, Value: 20}
+	assert.False(t, seen(d, dedupKeyOf(measurement, false)))
+	assert.True(t, seen(d, dedupKeyOf(measurement, false)))
+
+	// the same time of another metric or sensor
+	humidity := &models.MeasurementDto{SensorId: 1, Metric: "humidity", Time: now, Value: 40}
+	assert.False(t, seen(d, dedupKeyOf(humidity, false)))
+	otherSensor := &models.MeasurementDto{SensorId: 2, Metric: "temperature", Time: now, Value: 20}
+	assert.False(t, seen(d, dedupKeyOf(otherSensor, false)))
+
+	// the client's id is used instead of the time
+	withId := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: now, MeasurementId: "abc"}
+	assert.False(t, seen(d, dedupKeyOf(withId, false)))
+	withId.Time = now.Add(time.Second)
+	assert.True(t, seen(d, dedupKeyOf(withId, false)))
+
+	// after the window
+	now = now.Add(time.Minute)
+	assert.False(t, seen(d, dedupKeyOf(measurement, false)))
+	assert.Len(t, d.expires, 1)
+
+	// a failed one isn't remembered
+	key := dedupKeyOf(&models.MeasurementDto{SensorId: 3, Metric: "temperature", Time: now}, false)
+	duplicate, err := d.isDuplicate(context.Background(), key)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	d.done(key, false)
+	assert.False(t, seen(d, key))
+}
+
+func Test_deduplicator_Bounded(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	d := newDeduplicator(time.Hour, 10)
+	d.now = func() time.Time { return now }
+	for sensorId := 1; sensorId <= 100; sensorId++ {
+		measurement := &models.MeasurementDto{SensorId: sensorId, Metric: "temperature", Time: now}
+		assert.False(t, seen(d, dedupKeyOf(measurement, false)))
+	}
+	assert.Len(t, d.expires, 10)
+	// the oldest were forgotten
+	first := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: now}
+	assert.False(t, seen(d, dedupKeyOf(first, false)))
+	last := &models.MeasurementDto{SensorId: 100, Metric: "temperature", Time: now}
+	assert.True(t, seen(d, dedupKeyOf(last, false)))
+}
+
+func Test_deduplicator_Parallel(t *testing.T) {
+	d := newDeduplicator(time.Minute, 10)
+	measurement := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: time.Now()}
+	var stored atomic.Int32
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !seen(d, dedupKeyOf(measurement, false)) {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), stored.Load())
+}
+
+func Test_deduplicator_RetryWaitsInFlight(t *testing.T) {
+	d := newDeduplicator(time.Minute, 10)
+	key := dedupKeyOf(&models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: time.Now()}, false)
+	duplicate, err := d.isDuplicate(context.Background(), key)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	// the retry waits while the first attempt is being stored
+	retried := make(chan bool)
+	go func() {
+		duplicate, _ := d.isDuplicate(context.Background(), key)
+		retried <- duplicate
+	}()
+	select {
+	case <-retried:
+		t.Fatal("the retry didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the first attempt failed so the retry is stored
+	d.done(key, false)
+	assert.False(t, <-retried)
+	d.done(key, true)
+	assert.True(t, seen(d, key))
+
+	// a cancelled retry gives up while the first attempt is being stored
+	inFlight := dedupKeyOf(&models.MeasurementDto{SensorId: 2, Metric: "temperature", Time: time.Now()}, false)
+	_, err = d.isDuplicate(context.Background(), inFlight)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.isDuplicate(ctx, inFlight)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_dedupKeyOf_ServerTime(t *testing.T) {
+	d := newDeduplicator(time.Minute, 10)
+	clockless := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Value: 20}
+	assert.False(t, seen(d, dedupKeyOf(clockless, true)))
+	assert.False(t, seen(d, dedupKeyOf(clockless, true)))
+	assert.Empty(t, d.expires)
+
+	// the measurementId identifies a retry of a clockless sensor
+	clockless.MeasurementId = "abc"
+	assert.False(t, seen(d, dedupKeyOf(clockless, true)))
+	assert.True(t, seen(d, dedupKeyOf(clockless, true)))
+}
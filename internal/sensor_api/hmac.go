@@ -0,0 +1,108 @@
+package sensor_api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"hash"
+	"sync"
+	"time"
+)
+
+// Headers of a signed measurement request.
+// The X-Signature is a hex encoded HMAC-SHA256 of the `timestamp + "." + body` with the sensor's shared secret.
+// The X-Timestamp is a Unix time in seconds when the request was signed.
+var (
+	signatureHeader      = []byte("X-Signature")
+	signatureHeaderLower = []byte("x-signature")
+	timestampHeader      = []byte("X-Timestamp")
+	timestampHeaderLower = []byte("x-timestamp")
+	signatureSeparator   = []byte(".")
+)
+
+var (
+	ErrSignatureMissing = errors.New("signature missing")
+	ErrSignatureInvalid = errors.New("signature invalid")
+	ErrSignatureExpired = errors.New("signature timestamp outside of the allowed window")
+)
+
+// hmacVerifier checks signatures of measurements sent by sensors with a shared secret
+type hmacVerifier struct {
+	// macPools reusable HMAC hashes for each sensor to avoid allocations on the hot path
+	macPools map[int]*sync.Pool
+	window   time.Duration
+	now      func() time.Time
+}
+
+func newHmacVerifier(secrets map[int]string, window time.Duration) *hmacVerifier {
+	macPools := make(map[int]*sync.Pool, len(secrets))
+	for sensorId, secret := range secrets {
+		key := []byte(secret)
+		macPools[sensorId] = &sync.Pool{
+			New: func() any {
+				return hmac.New(sha256.New, key)
+			},
+		}
+	}
+	return &hmacVerifier{
+		macPools: macPools,
+		window:   window,
+		now:      time.Now,
+	}
+}
+
+// verify the request signature of the sensor. Sensors without a secret are always accepted.
+func (v *hmacVerifier) verify(sensorId int, reqHeader *fasthttp.RequestHeader, body []byte) error {
+	macPool, found := v.macPools[sensorId]
+	if !found {
+		return nil
+	}
+	signatureHex := peekHeader(reqHeader, signatureHeader, signatureHeaderLower)
+	timestamp := peekHeader(reqHeader, timestampHeader, timestampHeaderLower)
+	if len(signatureHex) == 0 || len(timestamp) == 0 {
+		return ErrSignatureMissing
+	}
+	signedAt, err := fasthttp.ParseUint(timestamp)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	// reject replays: the timestamp is a part of the signed data so it can't be changed
+	diff := v.now().Sub(time.Unix(int64(signedAt), 0))
+	if diff > v.window || diff < -v.window {
+		return ErrSignatureExpired
+	}
+	var signature [sha256.Size]byte
+	if hex.DecodedLen(len(signatureHex)) != sha256.Size {
+		return ErrSignatureInvalid
+	}
+	_, err = hex.Decode(signature[:], signatureHex)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	mac := macPool.Get().(hash.Hash)
+	mac.Reset()
+	_, _ = mac.Write(timestamp)
+	_, _ = mac.Write(signatureSeparator)
+	_, _ = mac.Write(body)
+	var expected [sha256.Size]byte
+	mac.Sum(expected[:0])
+	macPool.Put(mac)
+
+	// constant time comparison
+	if !hmac.Equal(signature[:], expected[:]) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// peekHeader returns a header value. The header names normalizing is disabled so also check a lower case name.
+func peekHeader(reqHeader *fasthttp.RequestHeader, name, nameLower []byte) []byte {
+	val := reqHeader.PeekBytes(name)
+	if val == nil {
+		val = reqHeader.PeekBytes(nameLower)
+	}
+	return val
+}
@@ -0,0 +1,92 @@
+package sensor_api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var signedBody = []byte(`{"sensorId":1,"time":"2023-10-03T00:00:00.000Z","value":42}`)
+
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newSignedHeader(signature, timestamp string) *fasthttp.RequestHeader {
+	reqHeader := &fasthttp.RequestHeader{}
+	reqHeader.DisableNormalizing()
+	if signature != "" {
+		reqHeader.Set("X-Signature", signature)
+	}
+	if timestamp != "" {
+		reqHeader.Set("X-Timestamp", timestamp)
+	}
+	return reqHeader
+}
+
+func Test_hmacVerifier_verify(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	verifier := newHmacVerifier(map[int]string{1: "s3cr3t"}, time.Minute)
+	verifier.now = func() time.Time { return now }
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	// sensor without a secret doesn't need a signature
+	assert.NoError(t, verifier.verify(2, newSignedHeader("", ""), signedBody))
+
+	signature := sign("s3cr3t", timestamp, signedBody)
+	assert.NoError(t, verifier.verify(1, newSignedHeader(signature, timestamp), signedBody))
+
+	// lower case headers e.g. after an HTTP/2 proxy
+	reqHeader := &fasthttp.RequestHeader{}
+	reqHeader.DisableNormalizing()
+	reqHeader.Set("x-signature", signature)
+	reqHeader.Set("x-timestamp", timestamp)
+	assert.NoError(t, verifier.verify(1, reqHeader, signedBody))
+
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader("", ""), signedBody), ErrSignatureMissing)
+
+	wrongSecret := sign("wrong", timestamp, signedBody)
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader(wrongSecret, timestamp), signedBody), ErrSignatureInvalid)
+
+	tamperedBody := []byte(`{"sensorId":1,"time":"2023-10-03T00:00:00.000Z","value":-42}`)
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader(signature, timestamp), tamperedBody), ErrSignatureInvalid)
+
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader("abc", timestamp), signedBody), ErrSignatureInvalid)
+}
+
+func Test_hmacVerifier_verify_Replay(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	verifier := newHmacVerifier(map[int]string{1: "s3cr3t"}, time.Minute)
+	verifier.now = func() time.Time { return now }
+
+	oldTimestamp := strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)
+	signature := sign("s3cr3t", oldTimestamp, signedBody)
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader(signature, oldTimestamp), signedBody), ErrSignatureExpired)
+
+	futureTimestamp := strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10)
+	signature = sign("s3cr3t", futureTimestamp, signedBody)
+	assert.ErrorIs(t, verifier.verify(1, newSignedHeader(signature, futureTimestamp), signedBody), ErrSignatureExpired)
+}
+
+func Benchmark_hmacVerifier_verify(b *testing.B) {
+	now := time.Now()
+	verifier := newHmacVerifier(map[int]string{1: "s3cr3t"}, time.Minute)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	reqHeader := newSignedHeader(sign("s3cr3t", timestamp, signedBody), timestamp)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := verifier.verify(1, reqHeader, signedBody)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package sensor_api
+
+import (
+	"bytes"
+	"fmt"
+	"sensord/internal/models"
+	"sensord/internal/units"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxJsonDepth of nested unknown values that are skipped
+const maxJsonDepth = 32
+
+// DecodeError a malformed body with an offset of the failed byte
+type DecodeError struct {
+	Offset  int
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Message, e.Offset)
+}
+
+// internedStrings known metrics and units so decoding them doesn't allocate a string
+var internedStrings = map[string]string{}
+
+func init() {
+	for metric, unit := range models.MetricUnits {
+		internedStrings[metric] = metric
+		internedStrings[unit] = unit
+	}
+	for _, unit := range units.Names() {
+		internedStrings[unit] = unit
+	}
+}
+
+// jsonDecoder decodes the measurement JSON without reflection.
+// It's reused from the pool so decoding of a measurement with a known metric and unit doesn't allocate.
+// Keys are matched case-insensitively and null values are ignored as with the encoding/json.
+type jsonDecoder struct {
+	data []byte
+	pos  int
+	// strict rejects unknown fields
+	strict bool
+	// buf for unescaped strings
+	buf []byte
+}
+
+var jsonDecoderPool = sync.Pool{
+	New: func() any {
+		return &jsonDecoder{}
+	},
+}
+
+func getJsonDecoder(data []byte, strict bool) *jsonDecoder {
+	d := jsonDecoderPool.Get().(*jsonDecoder)
+	d.data = data
+	d.pos = 0
+	d.strict = strict
+	return d
+}
+
+func putJsonDecoder(d *jsonDecoder) {
+	d.data = nil
+	jsonDecoderPool.Put(d)
+}
+
+func decodeJson(body []byte, measurement *models.MeasurementDto, strict bool) error {
+	d := getJsonDecoder(body, strict)
+	defer putJsonDecoder(d)
+	err := d.measurement(measurement)
+	if err != nil {
+		return err
+	}
+	return d.end()
+}
+
+func decodeJsonBatch(body []byte, strict bool) ([]*models.MeasurementDto, error) {
+	d := getJsonDecoder(body, strict)
+	defer putJsonDecoder(d)
+	d.skipSpace()
+	if d.literal("null") {
+		return nil, d.end()
+	}
+	if !d.consume('[') {
+		return nil, d.errorf("expected an array")
+	}
+	var measurements []*models.MeasurementDto
+	d.skipSpace()
+	if d.consume(']') {
+		return measurements, d.end()
+	}
+	for {
+		d.skipSpace()
+		if d.literal("null") {
+			measurements = append(measurements, nil)
+		} else {
+			measurement := &models.MeasurementDto{}
+			err := d.measurement(measurement)
+			if err != nil {
+				return nil, err
+			}
+			measurements = append(measurements, measurement)
+		}
+		d.skipSpace()
+		if d.consume(',') {
+			continue
+		}
+		if d.consume(']') {
+			return measurements, d.end()
+		}
+		return nil, d.errorf("expected , or ]")
+	}
+}
+
+func (d *jsonDecoder) measurement(measurement *models.MeasurementDto) error {
+	d.skipSpace()
+	if d.literal("null") {
+		return nil
+	}
+	if !d.consume('{') {
+		return d.errorf("expected an object")
+	}
+	d.skipSpace()
+	if d.consume('}') {
+		return nil
+	}
+	for {
+		d.skipSpace()
+		keyOffset := d.pos
+		key, err := d.string()
+		if err != nil {
+			return err
+		}
+		d.skipSpace()
+		if !d.consume(':') {
+			return d.errorf("expected :")
+		}
+		d.skipSpace()
+		if d.literal("null") {
+			// keep the field unchanged
+		} else if equalFold(key, "sensorId") {
+			measurement.SensorId, err = d.int()
+		} else if equalFold(key, "time") {
+			measurement.Time, err = d.time()
+		} else if equalFold(key, "value") {
+			measurement.Value, err = d.float()
+		} else if equalFold(key, "metric") {
+			measurement.Metric, err = d.stringValue()
+		} else if equalFold(key, "unit") {
+			measurement.Unit, err = d.stringValue()
+		} else if equalFold(key, "measurementId") {
+			measurement.MeasurementId, err = d.stringValue()
+		} else if d.strict {
+			return &DecodeError{keyOffset, fmt.Sprintf("unknown field %q", key)}
+		} else {
+			err = d.skipValue(0)
+		}
+		if err != nil {
+			return err
+		}
+		d.skipSpace()
+		if d.consume(',') {
+			continue
+		}
+		if d.consume('}') {
+			return nil
+		}
+		return d.errorf("expected , or }")
+	}
+}
+
+// end checks that there is nothing after the value
+func (d *jsonDecoder) end() error {
+	d.skipSpace()
+	if d.pos < len(d.data) {
+		return d.errorf("unexpected data after the value")
+	}
+	return nil
+}
+
+func (d *jsonDecoder) errorf(format string, args ...any) *DecodeError {
+	if d.pos >= len(d.data) {
+		return &DecodeError{d.pos, "unexpected end of JSON"}
+	}
+	return &DecodeError{d.pos, fmt.Sprintf(format, args...)}
+}
+
+func (d *jsonDecoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\r', '\n':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (d *jsonDecoder) consume(c byte) bool {
+	if d.pos < len(d.data) && d.data[d.pos] == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *jsonDecoder) literal(lit string) bool {
+	if bytes.HasPrefix(d.data[d.pos:], []byte(lit)) {
+		d.pos += len(lit)
+		return true
+	}
+	return false
+}
+
+// string returns the unescaped string. It's valid until the next call.
+func (d *jsonDecoder) string() ([]byte, error) {
+	if !d.consume('"') {
+		return nil, d.errorf("expected a string")
+	}
+	start := d.pos
+	// fast path without escapes
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+		if c == '"' {
+			d.pos++
+			return d.data[start : d.pos-1], nil
+		}
+		if c == '\\' {
+			break
+		}
+		if c < 0x20 {
+			return nil, d.errorf("invalid character in a string")
+		}
+		d.pos++
+	}
+	d.buf = append(d.buf[:0], d.data[start:d.pos]...)
+	for d.pos < len(d.data) {
+		c := d.data[d.pos]
+		switch {
+		case c == '"':
+			d.pos++
+			return d.buf, nil
+		case c < 0x20:
+			return nil, d.errorf("invalid character in a string")
+		case c != '\\':
+			d.buf = append(d.buf, c)
+			d.pos++
+			continue
+		}
+		// escape
+		d.pos++
+		if d.pos >= len(d.data) {
+			break
+		}
+		switch d.data[d.pos] {
+		case '"', '\\', '/':
+			d.buf = append(d.buf, d.data[d.pos])
+		case 'b':
+			d.buf = append(d.buf, '\b')
+		case 'f':
+			d.buf = append(d.buf, '\f')
+		case 'n':
+			d.buf = append(d.buf, '\n')
+		case 'r':
+			d.buf = append(d.buf, '\r')
+		case 't':
+			d.buf = append(d.buf, '\t')
+		case 'u':
+			r, ok := d.hexRune(d.pos + 1)
+			if !ok {
+				return nil, d.errorf("invalid unicode escape")
+			}
+			d.pos += 4
+			if utf16.IsSurrogate(r) {
+				low, ok := d.hexRune(d.pos + 3)
+				if ok && d.data[d.pos+1] == '\\' && d.data[d.pos+2] == 'u' {
+					r = utf16.DecodeRune(r, low)
+					if r != utf8.RuneError {
+						d.pos += 6
+					}
+				} else {
+					r = utf8.RuneError
+				}
+			}
+			d.buf = utf8.AppendRune(d.buf, r)
+		default:
+			return nil, d.errorf("invalid escape")
+		}
+		d.pos++
+	}
+	return nil, d.errorf("unterminated string")
+}
+
+// hexRune parses 4 hex digits at the offset
+func (d *jsonDecoder) hexRune(offset int) (rune, bool) {
+	if offset+4 > len(d.data) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range d.data[offset : offset+4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, true
+}
+
+// stringValue returns an interned string for known metrics and units
+func (d *jsonDecoder) stringValue() (string, error) {
+	val, err := d.string()
+	if err != nil {
+		return "", err
+	}
+	// the lookup with the conversion doesn't allocate
+	if interned, found := internedStrings[string(val)]; found {
+		return interned, nil
+	}
+	return string(val), nil
+}
+
+// number returns a JSON number and true if it's an integer
+func (d *jsonDecoder) number() ([]byte, bool, error) {
+	start := d.pos
+	d.consume('-')
+	if d.consume('0') {
+		// no leading zeros
+	} else if d.digits() == 0 {
+		return nil, false, d.errorf("expected a number")
+	}
+	integer := true
+	if d.consume('.') {
+		integer = false
+		if d.digits() == 0 {
+			return nil, false, d.errorf("expected a digit")
+		}
+	}
+	if d.consume('e') || d.consume('E') {
+		integer = false
+		if !d.consume('+') {
+			d.consume('-')
+		}
+		if d.digits() == 0 {
+			return nil, false, d.errorf("expected a digit")
+		}
+	}
+	return d.data[start:d.pos], integer, nil
+}
+
+func (d *jsonDecoder) digits() int {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] >= '0' && d.data[d.pos] <= '9' {
+		d.pos++
+	}
+	return d.pos - start
+}
+
+func (d *jsonDecoder) int() (int, error) {
+	start := d.pos
+	num, integer, err := d.number()
+	if err != nil {
+		return 0, err
+	}
+	if !integer {
+		return 0, &DecodeError{start, "expected an integer"}
+	}
+	val, err := strconv.ParseInt(string(num), 10, 0)
+	if err != nil {
+		return 0, &DecodeError{start, "integer is out of range"}
+	}
+	return int(val), nil
+}
+
+func (d *jsonDecoder) float() (float64, error) {
+	start := d.pos
+	num, _, err := d.number()
+	if err != nil {
+		return 0, err
+	}
+	val, err := strconv.ParseFloat(string(num), 64)
+	if err != nil {
+		return 0, &DecodeError{start, "number is out of range"}
+	}
+	return val, nil
+}
+
+// time parses an RFC3339 time
+func (d *jsonDecoder) time() (time.Time, error) {
+	start := d.pos
+	val, err := d.string()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, ok := parseRfc3339(val)
+	if !ok {
+		// the time package explains what is wrong
+		t, err = time.Parse(time.RFC3339, string(val))
+		if err != nil {
+			return time.Time{}, &DecodeError{start, err.Error()}
+		}
+	}
+	return t, nil
+}
+
+// skipValue of an unknown field
+func (d *jsonDecoder) skipValue(depth int) error {
+	if depth > maxJsonDepth {
+		return d.errorf("too deep nesting")
+	}
+	if d.pos >= len(d.data) {
+		return d.errorf("expected a value")
+	}
+	var err error
+	switch d.data[d.pos] {
+	case '"':
+		_, err = d.string()
+	case '{':
+		d.pos++
+		d.skipSpace()
+		if d.consume('}') {
+			return nil
+		}
+		for {
+			d.skipSpace()
+			_, err = d.string()
+			if err != nil {
+				return err
+			}
+			d.skipSpace()
+			if !d.consume(':') {
+				return d.errorf("expected :")
+			}
+			d.skipSpace()
+			err = d.skipValue(depth + 1)
+			if err != nil {
+				return err
+			}
+			d.skipSpace()
+			if d.consume('}') {
+				return nil
+			}
+			if !d.consume(',') {
+				return d.errorf("expected , or }")
+			}
+		}
+	case '[':
+		d.pos++
+		d.skipSpace()
+		if d.consume(']') {
+			return nil
+		}
+		for {
+			d.skipSpace()
+			err = d.skipValue(depth + 1)
+			if err != nil {
+				return err
+			}
+			d.skipSpace()
+			if d.consume(']') {
+				return nil
+			}
+			if !d.consume(',') {
+				return d.errorf("expected , or ]")
+			}
+		}
+	case 't':
+		if !d.literal("true") {
+			return d.errorf("expected a value")
+		}
+	case 'f':
+		if !d.literal("false") {
+			return d.errorf("expected a value")
+		}
+	case 'n':
+		if !d.literal("null") {
+			return d.errorf("expected a value")
+		}
+	default:
+		_, _, err = d.number()
+	}
+	return err
+}
+
+// parseRfc3339 parses the `2006-01-02T15:04:05.999999999Z07:00` without allocations for the UTC.
+// Returns false if the time has another format or is invalid.
+func parseRfc3339(b []byte) (time.Time, bool) {
+	if len(b) < len("2006-01-02T15:04:05Z") || b[4] != '-' || b[7] != '-' || b[10] != 'T' || b[13] != ':' || b[16] != ':' {
+		return time.Time{}, false
+	}
+	year, ok1 := atoi(b[0:4])
+	month, ok2 := atoi(b[5:7])
+	day, ok3 := atoi(b[8:10])
+	hour, ok4 := atoi(b[11:13])
+	minute, ok5 := atoi(b[14:16])
+	sec, ok6 := atoi(b[17:19])
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 ||
+		month < 1 || month > 12 || day < 1 || day > daysIn(time.Month(month), year) ||
+		hour > 23 || minute > 59 || sec > 59 {
+		return time.Time{}, false
+	}
+	b = b[19:]
+	nsec := 0
+	if b[0] == '.' {
+		i := 1
+		for ; i < len(b) && b[i] >= '0' && b[i] <= '9'; i++ {
+			if i <= 9 {
+				nsec = nsec*10 + int(b[i]-'0')
+			}
+		}
+		if i == 1 {
+			return time.Time{}, false
+		}
+		for digits := i - 1; digits < 9; digits++ {
+			nsec *= 10
+		}
+		b = b[i:]
+	}
+	if len(b) == 1 && b[0] == 'Z' {
+		return time.Date(year, time.Month(month), day, hour, minute, sec, nsec, time.UTC), true
+	}
+	if len(b) != len("+07:00") || (b[0] != '+' && b[0] != '-') || b[3] != ':' {
+		return time.Time{}, false
+	}
+	zoneHour, ok1 := atoi(b[1:3])
+	zoneMinute, ok2 := atoi(b[4:6])
+	if !ok1 || !ok2 || zoneHour > 23 || zoneMinute > 59 {
+		return time.Time{}, false
+	}
+	offset := zoneHour*3600 + zoneMinute*60
+	if b[0] == '-' {
+		offset = -offset
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, sec, nsec, time.FixedZone("", offset)), true
+}
+
+func atoi(b []byte) (int, bool) {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+func daysIn(month time.Month, year int) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// equalFold compares an ASCII key case-insensitively
+func equalFold(key []byte, name string) bool {
+	if len(key) != len(name) {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		a, b := key[i], name[i]
+		if a|0x20 != b|0x20 {
+			return false
+		}
+	}
+	return true
+}
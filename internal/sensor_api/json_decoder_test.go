@@ -0,0 +1,176 @@
+package sensor_api
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sensord/internal/models"
+	"testing"
+	"time"
+)
+
+func Test_decodeJson(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected models.MeasurementDto
+	}{
+		{"minimal", `{"sensorId":1,"value":42}`, models.MeasurementDto{SensorId: 1, Value: 42}},
+		{"spaces", " {\n\t\"sensorId\" : 1 ,\r\n \"value\" : -0.5e1 } ", models.MeasurementDto{SensorId: 1, Value: -5}},
+		{"keys in other case", `{"SensorID":1,"VALUE":1}`, models.MeasurementDto{SensorId: 1, Value: 1}},
+		{"null fields", `{"sensorId":1,"metric":null,"time":null}`, models.MeasurementDto{SensorId: 1}},
+		{"last key wins", `{"sensorId":1,"sensorId":2}`, models.MeasurementDto{SensorId: 2}},
+		{"escapes", `{"measurementId":"a\"\\\/\b\f\n\r\té😀"}`, models.MeasurementDto{MeasurementId: "a\"\\/\b\f\n\r\té\U0001F600"}},
+		{"unknown fields", `{"sensorId":1,"battery":{"level":[1,2.5,"x",true,false,null,{}]},"value":3}`, models.MeasurementDto{SensorId: 1, Value: 3}},
+		{"time", `{"time":"2023-10-03T12:30:00.123Z"}`, models.MeasurementDto{Time: time.Date(2023, 10, 3, 12, 30, 0, 123000000, time.UTC)}},
+		{"empty", `{}`, models.MeasurementDto{}},
+		{"null", `null`, models.MeasurementDto{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			measurement := &models.MeasurementDto{}
+			err := decodeJson([]byte(tt.body), measurement, false)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, *measurement)
+
+			// the same as the encoding/json
+			expected := &models.MeasurementDto{}
+			assert.NoError(t, json.Unmarshal([]byte(tt.body), expected))
+			assert.Equal(t, expected, measurement)
+		})
+	}
+}
+
+func Test_decodeJson_Time(t *testing.T) {
+	times := []string{
+		"2023-10-03T12:30:00Z",
+		"2023-10-03T12:30:00.5Z",
+		"2023-10-03T12:30:00.123456789Z",
+		"2023-10-03T23:30:00+03:00",
+		"2023-10-03T01:30:00-07:30",
+		"2024-02-29T00:00:00Z",
+	}
+	for _, timeStr := range times {
+		t.Run(timeStr, func(t *testing.T) {
+			measurement := &models.MeasurementDto{}
+			err := decodeJson([]byte(`{"time":"`+timeStr+`"}`), measurement, false)
+			assert.NoError(t, err)
+			expected, _ := time.Parse(time.RFC3339, timeStr)
+			assert.True(t, expected.Equal(measurement.Time))
+			// the measurement day is in the sensor's zone
+			assert.Equal(t, expected.Format(time.RFC3339Nano), measurement.Time.Format(time.RFC3339Nano))
+		})
+	}
+}
+
+func Test_decodeJson_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		strict bool
+		offset int
+	}{
+		{"empty body", ``, false, 0},
+		{"not an object", `[]`, false, 0},
+		{"unterminated", `{"sensorId":1`, false, 13},
+		{"missing colon", `{"sensorId" 1}`, false, 12},
+		{"missing comma", `{"sensorId":1 "value":2}`, false, 14},
+		{"sensorId as a string", `{"sensorId":"1"}`, false, 12},
+		{"sensorId not an integer", `{"sensorId":1.5}`, false, 12},
+		{"sensorId overflow", `{"sensorId":99999999999999999999}`, false, 12},
+		{"leading plus", `{"value":+1}`, false, 9},
+		{"NaN", `{"value":NaN}`, false, 9},
+		{"no fraction digits", `{"value":1.}`, false, 11},
+		{"invalid time", `{"time":"2023-02-30T00:00:00Z"}`, false, 8},
+		{"invalid escape", `{"metric":"\x"}`, false, 12},
+		{"control character", "{\"metric\":\"a\nb\"}", false, 12},
+		{"trailing data", `{"sensorId":1}}`, false, 14},
+		{"invalid unknown value", `{"battery":tru}`, false, 11},
+		{"unknown field in strict mode", `{"sensorId":1,"battery":5}`, true, 14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := decodeJson([]byte(tt.body), &models.MeasurementDto{}, tt.strict)
+			var decodeErr *DecodeError
+			if assert.ErrorAs(t, err, &decodeErr) {
+				assert.Equal(t, tt.offset, decodeErr.Offset, decodeErr.Error())
+			}
+		})
+	}
+}
+
+func Test_decodeJson_TooDeep(t *testing.T) {
+	body := `{"battery":`
+	for i := 0; i < 100; i++ {
+		body += `[`
+	}
+	err := decodeJson([]byte(body), &models.MeasurementDto{}, false)
+	assert.ErrorContains(t, err, "too deep nesting")
+}
+
+func Test_decodeJsonBatch(t *testing.T) {
+	measurements, err := decodeJsonBatch([]byte(` [ {"sensorId":1} , null, {"sensorId":2} ] `), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.MeasurementDto{{SensorId: 1}, nil, {SensorId: 2}}, measurements)
+
+	measurements, err = decodeJsonBatch([]byte(`[]`), false)
+	assert.NoError(t, err)
+	assert.Empty(t, measurements)
+
+	_, err = decodeJsonBatch([]byte(`[{"sensorId":1},]`), false)
+	var decodeErr *DecodeError
+	assert.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, 16, decodeErr.Offset)
+
+	_, err = decodeJsonBatch([]byte(`{"sensorId":1}`), false)
+	assert.ErrorAs(t, err, &decodeErr)
+}
+
+func Test_decodeJson_NoAllocs(t *testing.T) {
+	measurement := &models.MeasurementDto{}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = decodeJson(jsonBodyWithoutId, measurement, true)
+	})
+	assert.Zero(t, allocs)
+}
+
+// the request span mustn't undo the zero allocations of the decoding when tracing is disabled
+func Test_startRequestSpan_NoAllocs(t *testing.T) {
+	reqCtx := &fasthttp.RequestCtx{}
+	reqCtx.Request.Header.SetMethod(http.MethodPost)
+	reqCtx.Request.SetRequestURI("/api/v1/measurement")
+	allocs := testing.AllocsPerRun(100, func() {
+		_, span := startRequestSpan(reqCtx)
+		endRequestSpan(span, http.StatusNoContent)
+	})
+	assert.Zero(t, allocs)
+
+	// the caller's trace id is still propagated to logs
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	reqCtx.Request.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := startRequestSpan(reqCtx)
+	assert.False(t, span.IsRecording())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(ctx).TraceID().String())
+}
+
+var jsonBodyWithoutId = []byte(`{"sensorId":1,"time":"2023-10-03T12:30:00.5Z","value":21.5,"metric":"humidity","unit":"percent"}`)
+
+func Benchmark_decodeJson_EncodingJson(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(jsonBody)))
+	for i := 0; i < b.N; i++ {
+		measurement := &models.MeasurementDto{}
+		err := json.Unmarshal(jsonBody, measurement)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_decodeJson_WithoutId(b *testing.B) {
+	benchmarkDecode(b, jsonFormat, jsonBodyWithoutId)
+}
@@ -0,0 +1,541 @@
+package sensor_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sensord/internal/core"
+	"sensord/internal/models"
+	"sensord/internal/units"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field numbers of the OTLP metrics ExportMetricsServiceRequest and its messages
+const (
+	protoExportRequestResourceMetrics protowire.Number = 1
+
+	protoResourceMetricsResource     protowire.Number = 1
+	protoResourceMetricsScopeMetrics protowire.Number = 2
+
+	protoResourceAttributes protowire.Number = 1
+
+	protoScopeMetricsMetrics protowire.Number = 2
+
+	protoMetricName                 protowire.Number = 1
+	protoMetricUnit                 protowire.Number = 3
+	protoMetricGauge                protowire.Number = 5
+	protoMetricSum                  protowire.Number = 7
+	protoMetricHistogram            protowire.Number = 9
+	protoMetricExponentialHistogram protowire.Number = 10
+	protoMetricSummary              protowire.Number = 11
+
+	// data_points of the Gauge, the Sum, the Histogram and others
+	protoDataPoints protowire.Number = 1
+
+	protoNumberDataPointTime       protowire.Number = 3
+	protoNumberDataPointAsDouble   protowire.Number = 4
+	protoNumberDataPointAsInt      protowire.Number = 6
+	protoNumberDataPointAttributes protowire.Number = 7
+	protoNumberDataPointFlags      protowire.Number = 8
+
+	protoKeyValueKey   protowire.Number = 1
+	protoKeyValueValue protowire.Number = 2
+
+	protoAnyValueString protowire.Number = 1
+	protoAnyValueInt    protowire.Number = 3
+
+	protoPartialSuccess                   protowire.Number = 1
+	protoPartialSuccessRejectedDataPoints protowire.Number = 1
+	protoPartialSuccessErrorMessage       protowire.Number = 2
+)
+
+// otlpFlagNoRecordedValue of a data point that marks a disappeared series like the Prometheus stale marker
+const otlpFlagNoRecordedValue = 1
+
+// maxOtlpErrorPoints how many rejected points are listed in the error message of the partial success
+const maxOtlpErrorPoints = 10
+
+// otlpPoint a data point of an OTLP metric
+type otlpPoint struct {
+	metric string
+	unit   string
+	// gauge is false for points of sums and histograms. Only gauges are measurements
+	gauge bool
+	// sensorId the value of the sensor attribute of the point or its resource. Empty if there is no attribute
+	sensorId string
+	time     time.Time
+	value    float64
+}
+
+// otlpMapping maps gauge data points of OTLP metrics to measurements
+type otlpMapping struct {
+	sensorAttribute string
+	metrics         map[string]core.MetricMapping
+}
+
+// newOtlpMapping or nil if no metrics are mapped and the OTLP receiver is disabled
+func newOtlpMapping(sensorAttribute string, metrics map[string]core.MetricMapping) *otlpMapping {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return &otlpMapping{sensorAttribute: sensorAttribute, metrics: metrics}
+}
+
+// otlpEncodingOf the Content-Type of the OTLP/HTTP request: the JSON or the Protobuf
+func otlpEncodingOf(contentType []byte) (jsonEncoded bool, supported bool) {
+	if i := bytes.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = bytes.TrimSpace(contentType)
+	switch {
+	case equalFold(contentType, "application/json"):
+		return true, true
+	case equalFold(contentType, "application/x-protobuf"):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// toMeasurement of the point or a reason why the point is rejected
+func (m *otlpMapping) toMeasurement(point *otlpPoint) (*models.MeasurementDto, *ValidationError) {
+	mapping, found := m.metrics[point.metric]
+	if !found {
+		return nil, &ValidationError{RuleMetric, fmt.Sprintf("metric %q is not mapped", point.metric)}
+	}
+	if !point.gauge {
+		return nil, &ValidationError{RuleMetric, fmt.Sprintf("metric %q is not a gauge", point.metric)}
+	}
+	sensorId, err := strconv.Atoi(point.sensorId)
+	if err != nil {
+		return nil, &ValidationError{RuleSensorId, fmt.Sprintf("attribute %q is not a sensor id", m.sensorAttribute)}
+	}
+	unit := mapping.Unit
+	if unit == "" && point.unit != "" && point.unit != "1" {
+		unit, found = units.FromUcum(point.unit)
+		if !found {
+			return nil, &ValidationError{RuleUnit, fmt.Sprintf("unit %q is unknown", point.unit)}
+		}
+	}
+	return &models.MeasurementDto{
+		SensorId: sensorId,
+		Time:     point.time,
+		Value:    point.value,
+		Metric:   mapping.Metric,
+		Unit:     unit,
+	}, nil
+}
+
+// otlpPartialSuccess lists the rejected points in the error message
+type otlpPartialSuccess struct {
+	rejected int
+	messages []string
+}
+
+func (p *otlpPartialSuccess) reject(point *otlpPoint, validationErr *ValidationError) {
+	p.rejected++
+	if len(p.messages) < maxOtlpErrorPoints {
+		p.messages = append(p.messages, fmt.Sprintf("%s of sensor %q: %s: %s", point.metric, point.sensorId, validationErr.Rule, validationErr.Message))
+	}
+}
+
+func (p *otlpPartialSuccess) errorMessage() string {
+	message := strings.Join(p.messages, "; ")
+	if p.rejected > len(p.messages) {
+		message += fmt.Sprintf("; and %d more", p.rejected-len(p.messages))
+	}
+	return message
+}
+
+// encodeProtobuf the ExportMetricsServiceResponse. It's empty if nothing was rejected
+func (p *otlpPartialSuccess) encodeProtobuf() []byte {
+	if p.rejected == 0 {
+		return nil
+	}
+	var partialSuccess []byte
+	partialSuccess = protowire.AppendTag(partialSuccess, protoPartialSuccessRejectedDataPoints, protowire.VarintType)
+	partialSuccess = protowire.AppendVarint(partialSuccess, uint64(p.rejected))
+	partialSuccess = protowire.AppendTag(partialSuccess, protoPartialSuccessErrorMessage, protowire.BytesType)
+	partialSuccess = protowire.AppendString(partialSuccess, p.errorMessage())
+	var msg []byte
+	msg = protowire.AppendTag(msg, protoPartialSuccess, protowire.BytesType)
+	return protowire.AppendBytes(msg, partialSuccess)
+}
+
+// encodeJson the ExportMetricsServiceResponse. The int64 is a string by the Protobuf JSON mapping
+func (p *otlpPartialSuccess) encodeJson() []byte {
+	if p.rejected == 0 {
+		return []byte(`{}`)
+	}
+	jsonBody, _ := json.Marshal(map[string]any{
+		"partialSuccess": map[string]string{
+			"rejectedDataPoints": strconv.Itoa(p.rejected),
+			"errorMessage":       p.errorMessage(),
+		},
+	})
+	return jsonBody
+}
+
+// forEachProtoField calls the fn with each field of the message.
+// The value is in the bytes of a length-delimited field or in the number of varint and fixed64 fields.
+func forEachProtoField(msg []byte, fn func(num protowire.Number, typ protowire.Type, bytes []byte, number uint64) error) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		var v []byte
+		var number uint64
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(msg)
+		case protowire.VarintType:
+			number, n = protowire.ConsumeVarint(msg)
+		case protowire.Fixed64Type:
+			number, n = protowire.ConsumeFixed64(msg)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		err := fn(num, typ, v, number)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeOtlpProtobuf decodes data points of the ExportMetricsServiceRequest
+func (m *otlpMapping) decodeOtlpProtobuf(msg []byte) ([]*otlpPoint, error) {
+	var points []*otlpPoint
+	err := forEachProtoField(msg, func(num protowire.Number, typ protowire.Type, resourceMetrics []byte, _ uint64) error {
+		if num != protoExportRequestResourceMetrics {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return errProtoWireType
+		}
+		var err error
+		points, err = m.decodeProtoResourceMetrics(resourceMetrics, points)
+		return err
+	})
+	return points, err
+}
+
+// decodeProtoResourceMetrics the resource attributes may follow the metrics so the metrics are decoded after
+func (m *otlpMapping) decodeProtoResourceMetrics(msg []byte, points []*otlpPoint) ([]*otlpPoint, error) {
+	var resourceSensorId string
+	var scopeMetrics [][]byte
+	err := forEachProtoField(msg, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if num != protoResourceMetricsResource && num != protoResourceMetricsScopeMetrics {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return errProtoWireType
+		}
+		if num == protoResourceMetricsScopeMetrics {
+			scopeMetrics = append(scopeMetrics, v)
+			return nil
+		}
+		return forEachProtoField(v, func(num protowire.Number, typ protowire.Type, attribute []byte, _ uint64) error {
+			if num != protoResourceAttributes || typ != protowire.BytesType {
+				return nil
+			}
+			sensorId, err := m.decodeProtoSensorAttribute(attribute)
+			if sensorId != "" {
+				resourceSensorId = sensorId
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range scopeMetrics {
+		err = forEachProtoField(scope, func(num protowire.Number, typ protowire.Type, metric []byte, _ uint64) error {
+			if num != protoScopeMetricsMetrics {
+				return nil
+			}
+			if typ != protowire.BytesType {
+				return errProtoWireType
+			}
+			var err error
+			points, err = m.decodeProtoMetric(metric, resourceSensorId, points)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return points, nil
+}
+
+// decodeProtoMetric appends data points of the metric. Points of other than gauges are only counted to be rejected.
+func (m *otlpMapping) decodeProtoMetric(msg []byte, resourceSensorId string, points []*otlpPoint) ([]*otlpPoint, error) {
+	var name, unit string
+	var gauge []byte
+	var others [][]byte
+	err := forEachProtoField(msg, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case protoMetricName, protoMetricUnit, protoMetricGauge,
+			protoMetricSum, protoMetricHistogram, protoMetricExponentialHistogram, protoMetricSummary:
+			if typ != protowire.BytesType {
+				return errProtoWireType
+			}
+		default:
+			return nil
+		}
+		switch num {
+		case protoMetricName:
+			name = string(v)
+		case protoMetricUnit:
+			unit = string(v)
+		case protoMetricGauge:
+			gauge = v
+		default:
+			others = append(others, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range others {
+		err = forEachProtoField(other, func(num protowire.Number, typ protowire.Type, _ []byte, _ uint64) error {
+			if num == protoDataPoints && typ == protowire.BytesType {
+				points = append(points, &otlpPoint{metric: name, unit: unit, sensorId: resourceSensorId})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = forEachProtoField(gauge, func(num protowire.Number, typ protowire.Type, dataPoint []byte, _ uint64) error {
+		if num != protoDataPoints {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return errProtoWireType
+		}
+		point := &otlpPoint{metric: name, unit: unit, gauge: true, sensorId: resourceSensorId}
+		recorded, err := m.decodeProtoNumberDataPoint(dataPoint, point)
+		if err != nil {
+			return err
+		}
+		// a point without a value isn't a 0 reading
+		if !recorded {
+			return nil
+		}
+		points = append(points, point)
+		return nil
+	})
+	return points, err
+}
+
+// decodeProtoNumberDataPoint the sensor attribute of the point overrides the resource's one.
+// Returns false if the point has no value or it's flagged as the NO_RECORDED_VALUE.
+func (m *otlpMapping) decodeProtoNumberDataPoint(msg []byte, point *otlpPoint) (bool, error) {
+	hasValue := false
+	noRecordedValue := false
+	err := forEachProtoField(msg, func(num protowire.Number, typ protowire.Type, v []byte, number uint64) error {
+		switch num {
+		case protoNumberDataPointTime:
+			if typ != protowire.Fixed64Type {
+				return errProtoWireType
+			}
+			if number != 0 {
+				point.time = time.Unix(0, int64(number)).UTC()
+			}
+		case protoNumberDataPointAsDouble:
+			if typ != protowire.Fixed64Type {
+				return errProtoWireType
+			}
+			point.value = math.Float64frombits(number)
+			hasValue = true
+		case protoNumberDataPointAsInt:
+			if typ != protowire.Fixed64Type {
+				return errProtoWireType
+			}
+			point.value = float64(int64(number))
+			hasValue = true
+		case protoNumberDataPointFlags:
+			if typ != protowire.VarintType {
+				return errProtoWireType
+			}
+			noRecordedValue = number&otlpFlagNoRecordedValue != 0
+		case protoNumberDataPointAttributes:
+			if typ != protowire.BytesType {
+				return errProtoWireType
+			}
+			sensorId, err := m.decodeProtoSensorAttribute(v)
+			if sensorId != "" {
+				point.sensorId = sensorId
+			}
+			return err
+		}
+		return nil
+	})
+	return hasValue && !noRecordedValue, err
+}
+
+// decodeProtoSensorAttribute returns the value of the KeyValue if it's the sensor attribute
+func (m *otlpMapping) decodeProtoSensorAttribute(msg []byte) (string, error) {
+	var key, value []byte
+	err := forEachProtoField(msg, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case protoKeyValueKey:
+			key = v
+		case protoKeyValueValue:
+			value = v
+		}
+		return nil
+	})
+	if err != nil || string(key) != m.sensorAttribute {
+		return "", err
+	}
+	var sensorId string
+	err = forEachProtoField(value, func(num protowire.Number, typ protowire.Type, v []byte, number uint64) error {
+		switch {
+		case num == protoAnyValueString && typ == protowire.BytesType:
+			sensorId = string(v)
+		case num == protoAnyValueInt && typ == protowire.VarintType:
+			sensorId = strconv.FormatInt(int64(number), 10)
+		}
+		return nil
+	})
+	return sensorId, err
+}
+
+// otlpJsonRequest the ExportMetricsServiceRequest in the OTLP/JSON encoding
+type otlpJsonRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []*otlpJsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []*otlpJsonMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpJsonMetric struct {
+	Name                 string              `json:"name"`
+	Unit                 string              `json:"unit"`
+	Gauge                *otlpJsonDataPoints `json:"gauge"`
+	Sum                  *otlpJsonDataPoints `json:"sum"`
+	Histogram            *otlpJsonDataPoints `json:"histogram"`
+	ExponentialHistogram *otlpJsonDataPoints `json:"exponentialHistogram"`
+	Summary              *otlpJsonDataPoints `json:"summary"`
+}
+
+type otlpJsonDataPoints struct {
+	DataPoints []*otlpJsonDataPoint `json:"dataPoints"`
+}
+
+type otlpJsonDataPoint struct {
+	Attributes   []*otlpJsonKeyValue `json:"attributes"`
+	TimeUnixNano otlpJsonInt64       `json:"timeUnixNano"`
+	AsDouble     *float64            `json:"asDouble"`
+	AsInt        *otlpJsonInt64      `json:"asInt"`
+	Flags        uint32              `json:"flags"`
+}
+
+type otlpJsonKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string        `json:"stringValue"`
+		IntValue    *otlpJsonInt64 `json:"intValue"`
+	} `json:"value"`
+}
+
+// otlpJsonInt64 the int64 is a decimal string by the Protobuf JSON mapping but a number is accepted too
+type otlpJsonInt64 int64
+
+func (i *otlpJsonInt64) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	num, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpJsonInt64(num)
+	return nil
+}
+
+// decodeOtlpJson decodes data points of the ExportMetricsServiceRequest in the OTLP/JSON encoding
+func (m *otlpMapping) decodeOtlpJson(body []byte) ([]*otlpPoint, error) {
+	request := &otlpJsonRequest{}
+	err := json.Unmarshal(body, request)
+	if err != nil {
+		return nil, err
+	}
+	var points []*otlpPoint
+	for _, resourceMetrics := range request.ResourceMetrics {
+		resourceSensorId := m.jsonSensorAttribute(resourceMetrics.Resource.Attributes)
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				if metric == nil {
+					continue
+				}
+				for _, others := range []*otlpJsonDataPoints{metric.Sum, metric.Histogram, metric.ExponentialHistogram, metric.Summary} {
+					if others == nil {
+						continue
+					}
+					for range others.DataPoints {
+						points = append(points, &otlpPoint{metric: metric.Name, unit: metric.Unit, sensorId: resourceSensorId})
+					}
+				}
+				if metric.Gauge == nil {
+					continue
+				}
+				for _, dataPoint := range metric.Gauge.DataPoints {
+					// a point without a value isn't a 0 reading
+					if dataPoint == nil || dataPoint.Flags&otlpFlagNoRecordedValue != 0 || (dataPoint.AsDouble == nil && dataPoint.AsInt == nil) {
+						continue
+					}
+					point := &otlpPoint{metric: metric.Name, unit: metric.Unit, gauge: true, sensorId: resourceSensorId}
+					if sensorId := m.jsonSensorAttribute(dataPoint.Attributes); sensorId != "" {
+						point.sensorId = sensorId
+					}
+					if dataPoint.TimeUnixNano != 0 {
+						point.time = time.Unix(0, int64(dataPoint.TimeUnixNano)).UTC()
+					}
+					if dataPoint.AsDouble != nil {
+						point.value = *dataPoint.AsDouble
+					} else {
+						point.value = float64(*dataPoint.AsInt)
+					}
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points, nil
+}
+
+// jsonSensorAttribute returns the value of the sensor attribute or empty if there is no attribute
+func (m *otlpMapping) jsonSensorAttribute(attributes []*otlpJsonKeyValue) string {
+	for _, attribute := range attributes {
+		if attribute == nil || attribute.Key != m.sensorAttribute {
+			continue
+		}
+		if attribute.Value.StringValue != nil {
+			return *attribute.Value.StringValue
+		}
+		if attribute.Value.IntValue != nil {
+			return strconv.FormatInt(int64(*attribute.Value.IntValue), 10)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,282 @@
+package sensor_api
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"sensord/internal/core"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type otlpDataPoint struct {
+	sensorId string
+	time     time.Time
+	value    float64
+	noValue  bool
+	flags    uint64
+}
+
+func otlpKeyValue(key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, protoAnyValueString, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	var msg []byte
+	msg = protowire.AppendTag(msg, protoKeyValueKey, protowire.BytesType)
+	msg = protowire.AppendString(msg, key)
+	msg = protowire.AppendTag(msg, protoKeyValueValue, protowire.BytesType)
+	return protowire.AppendBytes(msg, anyValue)
+}
+
+// otlpMetric of the data points in the gauge or in another type e.g. the sum
+func otlpMetric(name, unit string, typ protowire.Number, points ...otlpDataPoint) []byte {
+	var dataPoints []byte
+	for _, point := range points {
+		var pointMsg []byte
+		pointMsg = protowire.AppendTag(pointMsg, protoNumberDataPointTime, protowire.Fixed64Type)
+		pointMsg = protowire.AppendFixed64(pointMsg, uint64(point.time.UnixNano()))
+		if !point.noValue {
+			pointMsg = protowire.AppendTag(pointMsg, protoNumberDataPointAsDouble, protowire.Fixed64Type)
+			pointMsg = protowire.AppendFixed64(pointMsg, math.Float64bits(point.value))
+		}
+		if point.flags != 0 {
+			pointMsg = protowire.AppendTag(pointMsg, protoNumberDataPointFlags, protowire.VarintType)
+			pointMsg = protowire.AppendVarint(pointMsg, point.flags)
+		}
+		if point.sensorId != "" {
+			pointMsg = protowire.AppendTag(pointMsg, protoNumberDataPointAttributes, protowire.BytesType)
+			pointMsg = protowire.AppendBytes(pointMsg, otlpKeyValue("sensor.id", point.sensorId))
+		}
+		dataPoints = protowire.AppendTag(dataPoints, protoDataPoints, protowire.BytesType)
+		dataPoints = protowire.AppendBytes(dataPoints, pointMsg)
+	}
+	var msg []byte
+	msg = protowire.AppendTag(msg, typ, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, dataPoints)
+	msg = protowire.AppendTag(msg, protoMetricName, protowire.BytesType)
+	msg = protowire.AppendString(msg, name)
+	msg = protowire.AppendTag(msg, protoMetricUnit, protowire.BytesType)
+	return protowire.AppendString(msg, unit)
+}
+
+// otlpRequest of one resource with the sensor attribute. The resource follows its metrics on the wire.
+func otlpRequest(resourceSensorId string, metrics ...[]byte) []byte {
+	var scope []byte
+	for _, metric := range metrics {
+		scope = protowire.AppendTag(scope, protoScopeMetricsMetrics, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, metric)
+	}
+	var resourceMetrics []byte
+	resourceMetrics = protowire.AppendTag(resourceMetrics, protoResourceMetricsScopeMetrics, protowire.BytesType)
+	resourceMetrics = protowire.AppendBytes(resourceMetrics, scope)
+	if resourceSensorId != "" {
+		var resource []byte
+		resource = protowire.AppendTag(resource, protoResourceAttributes, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, otlpKeyValue("sensor.id", resourceSensorId))
+		resourceMetrics = protowire.AppendTag(resourceMetrics, protoResourceMetricsResource, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, resource)
+	}
+	var msg []byte
+	msg = protowire.AppendTag(msg, protoExportRequestResourceMetrics, protowire.BytesType)
+	return protowire.AppendBytes(msg, resourceMetrics)
+}
+
+var testOtlpMapping = newOtlpMapping("sensor.id", map[string]core.MetricMapping{
+	"room.temperature": {Metric: "temperature"},
+	"room.humidity":    {Metric: "humidity", Unit: "percent"},
+	"room.requests":    {Metric: "temperature"},
+})
+
+func Test_otlpMapping_decodeOtlpProtobuf(t *testing.T) {
+	pointTime := time.Date(2023, 10, 3, 12, 30, 0, 500, time.UTC)
+	body := otlpRequest("1",
+		otlpMetric("room.temperature", "Cel", protoMetricGauge,
+			otlpDataPoint{time: pointTime, value: 21.5},
+			// the point's attribute overrides the resource's one
+			otlpDataPoint{sensorId: "2", time: pointTime, value: 22},
+			// points without a value are skipped
+			otlpDataPoint{time: pointTime, value: 0, flags: otlpFlagNoRecordedValue},
+			otlpDataPoint{time: pointTime, noValue: true}),
+		otlpMetric("room.requests", "1", protoMetricSum, otlpDataPoint{time: pointTime, value: 5}),
+	)
+	points, err := testOtlpMapping.decodeOtlpProtobuf(body)
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+	assert.Equal(t, &otlpPoint{metric: "room.temperature", unit: "Cel", gauge: true, sensorId: "1", time: pointTime, value: 21.5}, points[0])
+	assert.Equal(t, &otlpPoint{metric: "room.temperature", unit: "Cel", gauge: true, sensorId: "2", time: pointTime, value: 22}, points[1])
+	assert.Equal(t, &otlpPoint{metric: "room.requests", unit: "1", sensorId: "1"}, points[2])
+
+	// malformed
+	_, err = testOtlpMapping.decodeOtlpProtobuf(body[:len(body)-1])
+	assert.Error(t, err)
+}
+
+func Test_otlpMapping_decodeOtlpJson(t *testing.T) {
+	pointTime := time.Date(2023, 10, 3, 12, 30, 0, 500, time.UTC)
+	body := []byte(`{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"sensor.id","value":{"intValue":"1"}}]},
+		"scopeMetrics":[{"metrics":[
+			{"name":"room.temperature","unit":"Cel","gauge":{"dataPoints":[
+				{"timeUnixNano":"` + strconv.FormatInt(pointTime.UnixNano(), 10) + `","asDouble":21.5},
+				{"attributes":[{"key":"sensor.id","value":{"stringValue":"2"}}],"asInt":"22"},
+				{"asDouble":0,"flags":1},
+				{"timeUnixNano":"` + strconv.FormatInt(pointTime.UnixNano(), 10) + `"}
+			]}},
+			{"name":"room.requests","sum":{"dataPoints":[{"asInt":5}]}}
+		]}]
+	}]}`)
+	points, err := testOtlpMapping.decodeOtlpJson(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []*otlpPoint{
+		{metric: "room.temperature", unit: "Cel", gauge: true, sensorId: "1", time: pointTime, value: 21.5},
+		{metric: "room.temperature", unit: "Cel", gauge: true, sensorId: "2", value: 22},
+		{metric: "room.requests", sensorId: "1"},
+	}, points)
+
+	_, err = testOtlpMapping.decodeOtlpJson([]byte(`{"resourceMetrics":`))
+	assert.Error(t, err)
+}
+
+func Test_otlpMapping_toMeasurement(t *testing.T) {
+	tests := []struct {
+		point        *otlpPoint
+		expectedRule string
+		expectedUnit string
+	}{
+		{&otlpPoint{metric: "room.temperature", unit: "Cel", gauge: true, sensorId: "1"}, "", "celsius"},
+		{&otlpPoint{metric: "room.temperature", unit: "[degF]", gauge: true, sensorId: "1"}, "", "fahrenheit"},
+		// the configured unit overrides the point's one
+		{&otlpPoint{metric: "room.humidity", unit: "1", gauge: true, sensorId: "1"}, "", "percent"},
+		{&otlpPoint{metric: "room.temperature", unit: "m", gauge: true, sensorId: "1"}, RuleUnit, ""},
+		{&otlpPoint{metric: "room.pressure", gauge: true, sensorId: "1"}, RuleMetric, ""},
+		{&otlpPoint{metric: "room.requests", sensorId: "1"}, RuleMetric, ""},
+		{&otlpPoint{metric: "room.temperature", gauge: true}, RuleSensorId, ""},
+	}
+	for _, tt := range tests {
+		measurement, validationErr := testOtlpMapping.toMeasurement(tt.point)
+		if tt.expectedRule == "" {
+			assert.Nil(t, validationErr)
+			assert.Equal(t, tt.expectedUnit, measurement.Unit)
+		} else {
+			assert.Equal(t, tt.expectedRule, validationErr.Rule)
+		}
+	}
+}
+
+func Test_otlpPartialSuccess(t *testing.T) {
+	partialSuccess := &otlpPartialSuccess{}
+	assert.Empty(t, partialSuccess.encodeProtobuf())
+	assert.Equal(t, `{}`, string(partialSuccess.encodeJson()))
+
+	for i := 0; i < maxOtlpErrorPoints+2; i++ {
+		partialSuccess.reject(&otlpPoint{metric: "room.pressure", sensorId: "1"}, &ValidationError{RuleMetric, "not mapped"})
+	}
+	assert.Contains(t, partialSuccess.errorMessage(), "; and 2 more")
+	assert.Contains(t, string(partialSuccess.encodeJson()), `"rejectedDataPoints":"12"`)
+
+	msg := partialSuccess.encodeProtobuf()
+	num, typ, n := protowire.ConsumeTag(msg)
+	assert.Equal(t, protoPartialSuccess, num)
+	assert.Equal(t, protowire.BytesType, typ)
+	inner, _ := protowire.ConsumeBytes(msg[n:])
+	num, _, n = protowire.ConsumeTag(inner)
+	assert.Equal(t, protoPartialSuccessRejectedDataPoints, num)
+	rejected, _ := protowire.ConsumeVarint(inner[n:])
+	assert.Equal(t, uint64(12), rejected)
+}
+
+func Test_SensorApiServer_handleOtlp(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+	s.otlp = testOtlpMapping
+	url := "http://" + listener.Addr().String() + "/v1/metrics"
+	now := time.Now()
+	body := otlpRequest("",
+		otlpMetric("room.temperature", "Cel", protoMetricGauge,
+			otlpDataPoint{sensorId: "1", time: now, value: 21.5},
+			// rejected points
+			otlpDataPoint{sensorId: "1000", time: now, value: 21.5},
+			otlpDataPoint{time: now, value: 21.5}),
+	)
+
+	post := func(contentType string, body []byte) (int, []byte) {
+		resp, err := http.Post(url, contentType, bytes.NewReader(body))
+		assert.NoError(t, err)
+		respBody, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, respBody
+	}
+	status, respBody := post("application/x-protobuf", body)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(1), s.registry.Get(1).MeasurementCount)
+	assert.Equal(t, 21.5, s.registry.Get(1).LastValues["temperature"])
+	assert.Nil(t, s.registry.Get(1000))
+	// the point without a sensor is rejected before the validation
+	partialSuccess := &otlpPartialSuccess{}
+	partialSuccess.reject(&otlpPoint{metric: "room.temperature"},
+		&ValidationError{RuleSensorId, `attribute "sensor.id" is not a sensor id`})
+	partialSuccess.reject(&otlpPoint{metric: "room.temperature", sensorId: "1000"},
+		&ValidationError{RuleSensorId, "sensorId 1000 is outside of [1, 100]"})
+	assert.Equal(t, partialSuccess.encodeProtobuf(), respBody)
+
+	status, respBody = post("application/json", []byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[
+		{"name":"room.temperature","gauge":{"dataPoints":[{"attributes":[{"key":"sensor.id","value":{"intValue":"2"}}],"asDouble":20}]}}
+	]}]}]}`))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{}`, string(respBody))
+	assert.Equal(t, int64(1), s.registry.Get(2).MeasurementCount)
+
+	status, _ = post("text/plain", body)
+	assert.Equal(t, http.StatusUnsupportedMediaType, status)
+	status, _ = post("application/x-protobuf", []byte("garbage"))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func Test_SensorApiServer_handleOtlp_Retry(t *testing.T) {
+	storage := &failingStorage{failSensorId: 2}
+	s, listener := startStorageServer(t, storage, func(conf *core.SensordConf) {
+		conf.DedupWindow = time.Minute
+		conf.DedupMaxEntries = 100
+	})
+	defer s.Shutdown(context.Background())
+	s.otlp = testOtlpMapping
+	url := "http://" + listener.Addr().String() + "/v1/metrics"
+	post := func(points string) (int, string) {
+		body := `{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"room.temperature","gauge":{"dataPoints":[` + points + `]}}]}]}]}`
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		respBody, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, string(respBody)
+	}
+	timeUnixNano := strconv.FormatInt(time.Now().UnixNano(), 10)
+	point := func(sensorId string, withTime bool) string {
+		p := `{"attributes":[{"key":"sensor.id","value":{"stringValue":"` + sensorId + `"}}],"asDouble":20`
+		if withTime {
+			p += `,"timeUnixNano":"` + timeUnixNano + `"`
+		}
+		return p + "}"
+	}
+
+	// the DB fails after the first point is stored
+	storage.failures.Store(1)
+	status, _ := post(point("1", true) + "," + point("2", true))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	// the retry stores the rest and doesn't count the first point twice
+	status, _ = post(point("1", true) + "," + point("2", true))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(2), storage.stored.Load())
+
+	// a point stamped with the server time would be stored again by a retry so the rest is rejected
+	storage.failures.Store(1)
+	status, respBody := post(point("3", false) + "," + point("2", false) + "," + point("4", true))
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"partialSuccess":{"rejectedDataPoints":"2","errorMessage":"room.temperature of sensor \"2\": storage_error: unable to store; room.temperature of sensor \"4\": storage_error: unable to store"}}`, respBody)
+	assert.Equal(t, int32(3), storage.stored.Load())
+}
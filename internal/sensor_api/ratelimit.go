@@ -0,0 +1,130 @@
+package sensor_api
+
+import (
+	"expvar"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Rate limiter metrics published on the Admin API /debug/vars
+var (
+	// rateLimitedTotal counts rejected requests by the limit: `sensor` or `ip`
+	rateLimitedTotal = expvar.NewMap("sensord_rate_limited_total")
+	// rateLimitBuckets current number of tracked sensors and IPs
+	rateLimitBuckets = expvar.NewMap("sensord_rate_limit_buckets")
+)
+
+// sweepInterval how often idle buckets are removed to keep memory bounded
+const sweepInterval = time.Minute
+
+// tokenBucket allows `burst` requests at once and then refills with `rate` tokens per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket for each key e.g. sensorId or source IP
+type rateLimiter[K comparable] struct {
+	name string
+	// rate tokens per second
+	rate  float64
+	burst float64
+	// overrides per-key rates. Zero disables the limit for the key.
+	overrides map[K]float64
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[K]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter creates a limiter or returns nil if the limit is disabled
+func newRateLimiter[K comparable](name string, rate float64, burst int, overrides map[K]float64) *rateLimiter[K] {
+	if rate <= 0 && len(overrides) == 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter[K]{
+		name:      name,
+		rate:      rate,
+		burst:     float64(burst),
+		overrides: overrides,
+		now:       time.Now,
+		buckets:   map[K]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for the key. If there are no tokens then returns false and a time to wait for the next one.
+func (l *rateLimiter[K]) allow(key K) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	rate := l.rate
+	if override, found := l.overrides[key]; found {
+		rate = override
+	}
+	if rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	// refill
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*rate)
+		bucket.last = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	rateLimitedTotal.Add(l.name, 1)
+	retryAfter := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	return false, retryAfter
+}
+
+// sweep removes buckets that are full again. A new bucket would be the same so nothing is lost.
+func (l *rateLimiter[K]) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		rate := l.rate
+		if override, found := l.overrides[key]; found {
+			rate = override
+		}
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+	rateLimitBuckets.Set(l.name, expvarInt(len(l.buckets)))
+}
+
+// ipLimitKey the bucket of a source IP. An IPv6 client usually has a whole /64 and could rotate addresses in it
+// so the addresses of a /64 share one bucket.
+func ipLimitKey(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 32)
+	}
+	return netip.PrefixFrom(addr, 64).Masked()
+}
+
+func expvarInt(val int) *expvar.Int {
+	v := &expvar.Int{}
+	v.Set(int64(val))
+	return v
+}
@@ -0,0 +1,73 @@
+package sensor_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter_allow(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter("test", 1, 2, map[int]float64{2: 0, 3: 10})
+	limiter.now = func() time.Time { return now }
+
+	// burst
+	allowed, _ := limiter.allow(1)
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow(1)
+	assert.True(t, allowed)
+	allowed, retryAfter := limiter.allow(1)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// refill a half of a token
+	now = now.Add(500 * time.Millisecond)
+	allowed, retryAfter = limiter.allow(1)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.allow(1)
+	assert.True(t, allowed)
+
+	// override disables the limit
+	for i := 0; i < 100; i++ {
+		allowed, _ = limiter.allow(2)
+		assert.True(t, allowed)
+	}
+	assert.NotContains(t, limiter.buckets, 2)
+
+	// other sensors have their own buckets
+	allowed, _ = limiter.allow(3)
+	assert.True(t, allowed)
+}
+
+func Test_rateLimiter_sweep(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter[int]("test", 1, 2, nil)
+	limiter.now = func() time.Time { return now }
+	limiter.lastSweep = now
+	for sensorId := 0; sensorId < 100; sensorId++ {
+		limiter.allow(sensorId)
+	}
+	assert.Len(t, limiter.buckets, 100)
+	now = now.Add(sweepInterval)
+	limiter.allow(1)
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func Test_rateLimiter_Disabled(t *testing.T) {
+	limiter := newRateLimiter[int]("test", 0, 10, nil)
+	assert.Nil(t, limiter)
+	allowed, _ := limiter.allow(1)
+	assert.True(t, allowed)
+}
+
+func Test_ipLimitKey(t *testing.T) {
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.1/32"), ipLimitKey(netip.MustParseAddr("192.0.2.1")))
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.1/32"), ipLimitKey(netip.MustParseAddr("::ffff:192.0.2.1")))
+	// addresses of a /64 share the bucket
+	assert.Equal(t, netip.MustParsePrefix("2001:db8:1:2::/64"), ipLimitKey(netip.MustParseAddr("2001:db8:1:2::1")))
+	assert.Equal(t, ipLimitKey(netip.MustParseAddr("2001:db8:1:2::1")), ipLimitKey(netip.MustParseAddr("2001:db8:1:2:ffff:1:2:3")))
+	assert.NotEqual(t, ipLimitKey(netip.MustParseAddr("2001:db8:1:2::1")), ipLimitKey(netip.MustParseAddr("2001:db8:1:3::1")))
+}
@@ -0,0 +1,75 @@
+package sensor_api
+
+import (
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"maps"
+	"net/netip"
+	"sensord/internal/certs"
+	"sensord/internal/core"
+)
+
+// ingestRules settings of the ingestion that a reload replaces at once.
+// A request reads them once per step so it never sees a half-applied config.
+type ingestRules struct {
+	hmacVerifier *hmacVerifier
+	// bindSensor requires the client certificate to match the sensorId
+	bindSensor bool
+	// strictDecoding rejects measurements with unknown fields
+	strictDecoding bool
+	sensorLimiter  *rateLimiter[int]
+	ipLimiter      *rateLimiter[netip.Prefix]
+	validator      *validator
+}
+
+// newIngestRules of the conf. Rate limiters of the old rules are kept if their limits are the same
+// so a reload of e.g. validation rules doesn't refill the buckets of all sensors.
+func newIngestRules(conf *core.SensordConf, old *ingestRules) *ingestRules {
+	rules := &ingestRules{
+		hmacVerifier:   newHmacVerifier(conf.SensorHmacSecrets, conf.SensorHmacWindow),
+		bindSensor:     conf.SensorTlsBindSensor,
+		strictDecoding: conf.SensorStrictDecoding,
+		sensorLimiter:  newRateLimiter("sensor", conf.SensorRateLimit, conf.SensorRateBurst, conf.SensorRateLimits),
+		ipLimiter:      newRateLimiter[netip.Prefix]("ip", conf.SensorIpRateLimit, conf.SensorIpRateBurst, nil),
+		validator:      newValidator(conf),
+	}
+	if old != nil {
+		rules.sensorLimiter = keepBuckets(old.sensorLimiter, rules.sensorLimiter)
+		rules.ipLimiter = keepBuckets(old.ipLimiter, rules.ipLimiter)
+	}
+	return rules
+}
+
+// keepBuckets returns the old limiter if it has the same limits as the new one
+func keepBuckets[K comparable](oldLimiter, newLimiter *rateLimiter[K]) *rateLimiter[K] {
+	if oldLimiter == nil || newLimiter == nil {
+		return newLimiter
+	}
+	if oldLimiter.rate == newLimiter.rate && oldLimiter.burst == newLimiter.burst && maps.Equal(oldLimiter.overrides, newLimiter.overrides) {
+		return oldLimiter
+	}
+	return newLimiter
+}
+
+// PrepareReload the rate limits, the validation rules, HMAC secrets and the TLS certificate.
+// Open connections are kept and new TLS handshakes get the new certificate.
+func (s *SensorApiServer) PrepareReload(conf *core.SensordConf) (func(), error) {
+	if (conf.SensorTlsCert != "") != (s.tlsCerts != nil) {
+		return nil, errors.New("SENSOR_TLS_CERT: TLS can't be enabled or disabled without a restart")
+	}
+	var tlsConfig *tls.Config
+	if s.tlsCerts != nil {
+		var err error
+		tlsConfig, err = certs.Load(conf.SensorTlsCert, conf.SensorTlsKey, conf.SensorTlsClientCa)
+		if err != nil {
+			return nil, errors.Wrap(err, "Sensor API")
+		}
+	}
+	rules := newIngestRules(conf, s.rules.Load())
+	return func() {
+		s.rules.Store(rules)
+		if tlsConfig != nil {
+			s.tlsCerts.Set(tlsConfig)
+		}
+	}, nil
+}
@@ -0,0 +1,63 @@
+package sensor_api
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sensord/internal/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_SensorApiServer_PrepareReload(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+	url := "http://" + listener.Addr().String() + "/api/v1/measurement"
+	post := func() int {
+		resp, err := http.Post(url, "application/json", strings.NewReader(`{"sensorId":50,"value":20}`))
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, post())
+
+	conf := &core.SensordConf{
+		SensorIdMin:  1,
+		SensorIdMax:  10,
+		MaxClockSkew: time.Minute,
+	}
+	commit, err := s.PrepareReload(conf)
+	assert.NoError(t, err)
+	// nothing is changed before the commit
+	assert.Equal(t, http.StatusNoContent, post())
+	commit()
+	assert.Equal(t, http.StatusBadRequest, post())
+
+	// TLS can't be enabled live
+	conf.SensorTlsCert = "sensor.pem"
+	conf.SensorTlsKey = "sensor.key"
+	_, err = s.PrepareReload(conf)
+	assert.ErrorContains(t, err, "SENSOR_TLS_CERT")
+}
+
+func Test_newIngestRules_KeepBuckets(t *testing.T) {
+	conf := &core.SensordConf{SensorRateLimit: 1, SensorRateBurst: 1, SensorIpRateLimit: 10, SensorIpRateBurst: 10}
+	rules := newIngestRules(conf, nil)
+	allowed, _ := rules.sensorLimiter.allow(1)
+	assert.True(t, allowed)
+
+	// the same limits keep the empty bucket of the sensor
+	conf.SensorIdMax = 100
+	reloaded := newIngestRules(conf, rules)
+	assert.Same(t, rules.sensorLimiter, reloaded.sensorLimiter)
+	allowed, _ = reloaded.sensorLimiter.allow(1)
+	assert.False(t, allowed)
+
+	// new limits start with full buckets
+	conf.SensorRateLimit = 2
+	reloaded = newIngestRules(conf, reloaded)
+	assert.NotSame(t, rules.sensorLimiter, reloaded.sensorLimiter)
+	assert.Same(t, rules.ipLimiter, reloaded.ipLimiter)
+	allowed, _ = reloaded.sensorLimiter.allow(1)
+	assert.True(t, allowed)
+}
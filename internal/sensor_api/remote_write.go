@@ -0,0 +1,227 @@
+package sensor_api
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sensord/internal/core"
+	"sensord/internal/models"
+	"strconv"
+	"time"
+)
+
+// Field numbers of the Prometheus remote-write prometheus.WriteRequest
+const (
+	protoWriteRequestTimeseries protowire.Number = 1
+
+	protoTimeSeriesLabels  protowire.Number = 1
+	protoTimeSeriesSamples protowire.Number = 2
+
+	protoLabelName  protowire.Number = 1
+	protoLabelValue protowire.Number = 2
+
+	protoSampleValue     protowire.Number = 1
+	protoSampleTimestamp protowire.Number = 2
+)
+
+// metricNameLabel the label of a Prometheus series with the metric name
+const metricNameLabel = "__name__"
+
+var ErrRemoteWriteTooLarge = errors.New("decoded remote-write request is too large")
+
+// remoteWriteMapping picks series of the Prometheus remote-write request and maps them to measurements
+type remoteWriteMapping struct {
+	sensorLabel string
+	metrics     map[string]core.MetricMapping
+}
+
+// newRemoteWriteMapping or nil if no metrics are mapped and the remote-write is disabled
+func newRemoteWriteMapping(sensorLabel string, metrics map[string]core.MetricMapping) *remoteWriteMapping {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return &remoteWriteMapping{sensorLabel: sensorLabel, metrics: metrics}
+}
+
+// decodeSnappy decodes the snappy block format body into the buf.
+// The decoded length is in the block header so a bomb is rejected before decoding.
+func decodeSnappy(body []byte, buf *bytes.Buffer, maxSize int) ([]byte, error) {
+	decodedLen, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, err
+	}
+	if decodedLen > maxSize {
+		return nil, ErrRemoteWriteTooLarge
+	}
+	buf.Grow(decodedLen)
+	return snappy.Decode(buf.Bytes()[:decodedLen], body)
+}
+
+// decode the WriteRequest into measurements. Each sample of a mapped series is a measurement.
+// Series of other metrics or without a valid sensor label are skipped.
+func (m *remoteWriteMapping) decode(msg []byte) ([]*models.MeasurementDto, error) {
+	var measurements []*models.MeasurementDto
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num != protoWriteRequestTimeseries {
+			// e.g. metadata
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		} else if typ != protowire.BytesType {
+			return nil, errProtoWireType
+		} else {
+			var series []byte
+			series, n = protowire.ConsumeBytes(msg)
+			if n >= 0 {
+				var err error
+				measurements, err = m.decodeTimeSeries(series, measurements)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return measurements, nil
+}
+
+// decodeTimeSeries appends samples of the series to the measurements if the series is mapped.
+// Labels may follow samples on the wire so the samples are decoded after all labels are known.
+func (m *remoteWriteMapping) decodeTimeSeries(msg []byte, measurements []*models.MeasurementDto) ([]*models.MeasurementDto, error) {
+	var metricName, sensorIdValue []byte
+	var samples [][]byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch num {
+		case protoTimeSeriesLabels, protoTimeSeriesSamples:
+			if typ != protowire.BytesType {
+				return nil, errProtoWireType
+			}
+			var v []byte
+			v, n = protowire.ConsumeBytes(msg)
+			if n < 0 {
+				break
+			}
+			if num == protoTimeSeriesSamples {
+				samples = append(samples, v)
+				break
+			}
+			name, value, err := decodeProtoLabel(v)
+			if err != nil {
+				return nil, err
+			}
+			switch string(name) {
+			case metricNameLabel:
+				metricName = value
+			case m.sensorLabel:
+				sensorIdValue = value
+			}
+		default:
+			// exemplars and native histograms
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	remoteWriteMetric, found := m.metrics[string(metricName)]
+	if !found {
+		return measurements, nil
+	}
+	sensorId, err := strconv.Atoi(string(sensorIdValue))
+	if err != nil {
+		return measurements, nil
+	}
+	for _, sample := range samples {
+		measurement := &models.MeasurementDto{
+			SensorId: sensorId,
+			Metric:   remoteWriteMetric.Metric,
+			Unit:     remoteWriteMetric.Unit,
+		}
+		err := decodeProtoSample(sample, measurement)
+		if err != nil {
+			return nil, err
+		}
+		// a stale marker of a disappeared series
+		if math.IsNaN(measurement.Value) {
+			continue
+		}
+		measurements = append(measurements, measurement)
+	}
+	return measurements, nil
+}
+
+// decodeProtoLabel decodes the prometheus.Label
+func decodeProtoLabel(msg []byte) ([]byte, []byte, error) {
+	var name, value []byte
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if (num == protoLabelName || num == protoLabelValue) && typ == protowire.BytesType {
+			var v []byte
+			v, n = protowire.ConsumeBytes(msg)
+			if num == protoLabelName {
+				name = v
+			} else {
+				value = v
+			}
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return name, value, nil
+}
+
+// decodeProtoSample decodes the prometheus.Sample with the timestamp in milliseconds
+func decodeProtoSample(msg []byte, measurement *models.MeasurementDto) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		switch num {
+		case protoSampleValue:
+			if typ != protowire.Fixed64Type {
+				return errProtoWireType
+			}
+			var v uint64
+			v, n = protowire.ConsumeFixed64(msg)
+			measurement.Value = math.Float64frombits(v)
+		case protoSampleTimestamp:
+			if typ != protowire.VarintType {
+				return errProtoWireType
+			}
+			var v uint64
+			v, n = protowire.ConsumeVarint(msg)
+			measurement.Time = time.UnixMilli(int64(v)).UTC()
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
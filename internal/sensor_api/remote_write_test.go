@@ -0,0 +1,228 @@
+package sensor_api
+
+import (
+	"bytes"
+	"context"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"sensord/internal/core"
+	"sensord/internal/models"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+func promLabel(name, value string) []byte {
+	var msg []byte
+	msg = protowire.AppendTag(msg, protoLabelName, protowire.BytesType)
+	msg = protowire.AppendString(msg, name)
+	msg = protowire.AppendTag(msg, protoLabelValue, protowire.BytesType)
+	msg = protowire.AppendString(msg, value)
+	return msg
+}
+
+func promSeries(labels map[string]string, samples ...promSample) []byte {
+	var msg []byte
+	// samples before labels: the order of fields on the wire is not guaranteed
+	for _, sample := range samples {
+		var sampleMsg []byte
+		sampleMsg = protowire.AppendTag(sampleMsg, protoSampleValue, protowire.Fixed64Type)
+		sampleMsg = protowire.AppendFixed64(sampleMsg, math.Float64bits(sample.value))
+		sampleMsg = protowire.AppendTag(sampleMsg, protoSampleTimestamp, protowire.VarintType)
+		sampleMsg = protowire.AppendVarint(sampleMsg, uint64(sample.timestamp))
+		msg = protowire.AppendTag(msg, protoTimeSeriesSamples, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, sampleMsg)
+	}
+	for name, value := range labels {
+		msg = protowire.AppendTag(msg, protoTimeSeriesLabels, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, promLabel(name, value))
+	}
+	return msg
+}
+
+// promWriteMessage the uncompressed WriteRequest
+func promWriteMessage(series ...[]byte) []byte {
+	var msg []byte
+	for _, s := range series {
+		msg = protowire.AppendTag(msg, protoWriteRequestTimeseries, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, s)
+	}
+	return msg
+}
+
+func promWriteRequest(series ...[]byte) []byte {
+	return snappy.Encode(nil, promWriteMessage(series...))
+}
+
+var testRemoteWriteMapping = newRemoteWriteMapping("sensor_id", map[string]core.MetricMapping{
+	"node_hwmon_temp_celsius": {Metric: "temperature"},
+	"room_temp_fahrenheit":    {Metric: "temperature", Unit: "fahrenheit"},
+})
+
+func Test_remoteWriteMapping_decode(t *testing.T) {
+	sampleTime := time.Date(2023, 10, 3, 12, 30, 0, 500*int(time.Millisecond), time.UTC)
+	body := promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1", "chip": "0"},
+			promSample{21.5, sampleTime.UnixMilli()}, promSample{22, sampleTime.UnixMilli() + 15000}),
+		promSeries(map[string]string{"__name__": "room_temp_fahrenheit", "sensor_id": "2"},
+			promSample{70, sampleTime.UnixMilli()}),
+		// not mapped
+		promSeries(map[string]string{"__name__": "node_load1", "sensor_id": "1"}, promSample{1, sampleTime.UnixMilli()}),
+		// without the sensor label
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius"}, promSample{1, sampleTime.UnixMilli()}),
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "x"}, promSample{1, sampleTime.UnixMilli()}),
+		// a stale marker
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "3"}, promSample{math.NaN(), sampleTime.UnixMilli()}),
+	)
+	msg, err := decodeSnappy(body, &bytes.Buffer{}, 1000)
+	assert.NoError(t, err)
+	measurements, err := testRemoteWriteMapping.decode(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []*models.MeasurementDto{
+		{SensorId: 1, Time: sampleTime, Value: 21.5, Metric: "temperature"},
+		{SensorId: 1, Time: sampleTime.Add(15 * time.Second), Value: 22, Metric: "temperature"},
+		{SensorId: 2, Time: sampleTime, Value: 70, Metric: "temperature", Unit: "fahrenheit"},
+	}, measurements)
+
+	// malformed
+	_, err = testRemoteWriteMapping.decode(msg[:len(msg)-1])
+	assert.Error(t, err)
+}
+
+func Test_decodeSnappy_TooLarge(t *testing.T) {
+	bomb := snappy.Encode(nil, make([]byte, 1<<20))
+	_, err := decodeSnappy(bomb, &bytes.Buffer{}, 1000)
+	assert.ErrorIs(t, err, ErrRemoteWriteTooLarge)
+
+	_, err = decodeSnappy([]byte("not snappy"), &bytes.Buffer{}, 1000)
+	assert.Error(t, err)
+}
+
+func Test_SensorApiServer_handleRemoteWrite(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+	s.remoteWrite = testRemoteWriteMapping
+	url := "http://" + listener.Addr().String() + "/api/v1/write"
+	now := time.Now().UnixMilli()
+	body := promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1"}, promSample{21.5, now}),
+		// invalid samples are skipped
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1000"}, promSample{21.5, now}),
+	)
+
+	post := func(encoding string, body []byte) int {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, post("snappy", body))
+	assert.Equal(t, int64(1), s.registry.Get(1).MeasurementCount)
+	assert.Equal(t, 21.5, s.registry.Get(1).LastValues["temperature"])
+	assert.Nil(t, s.registry.Get(1000))
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("gzip", body))
+	assert.Equal(t, http.StatusBadRequest, post("snappy", []byte("garbage")))
+}
+
+func Test_SensorApiServer_handleRemoteWrite_Signed(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{}, func(conf *core.SensordConf) {
+		conf.SensorHmacSecrets = map[int]string{1: "s3cr3t"}
+		conf.SensorHmacWindow = time.Minute
+	})
+	defer s.Shutdown(context.Background())
+	s.remoteWrite = testRemoteWriteMapping
+	url := "http://" + listener.Addr().String() + "/api/v1/write"
+	msg := promWriteMessage(promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1"}, promSample{21.5, time.Now().UnixMilli()}))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	post := func(signature string) int {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, msg)))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+	// the signature is of the decompressed body as for the other endpoints
+	assert.Equal(t, http.StatusUnauthorized, post(sign("s3cr3t", timestamp, snappy.Encode(nil, msg))))
+	assert.Nil(t, s.registry.Get(1))
+	assert.Equal(t, http.StatusNoContent, post(sign("s3cr3t", timestamp, msg)))
+	assert.Equal(t, int64(1), s.registry.Get(1).MeasurementCount)
+}
+
+func Test_SensorApiServer_handleRemoteWrite_Retry(t *testing.T) {
+	storage := &failingStorage{failSensorId: 2}
+	s, listener := startStorageServer(t, storage, func(conf *core.SensordConf) {
+		conf.DedupWindow = time.Minute
+		conf.DedupMaxEntries = 100
+		conf.SensorRateBurst = 3
+		conf.SensorRateLimit = 0.001
+		conf.ServerTimeSensors = map[int]bool{3: true}
+	})
+	defer s.Shutdown(context.Background())
+	s.remoteWrite = testRemoteWriteMapping
+	url := "http://" + listener.Addr().String() + "/api/v1/write"
+	now := time.Now().UnixMilli()
+	post := func(body []byte) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "snappy")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// the DB fails after the first sample is stored
+	body := promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1"}, promSample{21.5, now}),
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "2"}, promSample{22, now}),
+	)
+	storage.failures.Store(1)
+	resp := post(body)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	// the retry stores the rest and doesn't count the first sample twice
+	resp = post(body)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, int32(2), storage.stored.Load())
+
+	// over the sensor's rate limit Prometheus is asked to retry later. The retry above took a token too.
+	body = promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1"},
+			promSample{21, now + 1000}, promSample{21, now + 2000}),
+	)
+	resp = post(body)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Equal(t, int32(3), storage.stored.Load())
+
+	// a sample stamped with the server time would be stored again by a retry so the rest is dropped
+	body = promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "3"}, promSample{21, now}),
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "2"}, promSample{21, now + 1000}),
+	)
+	storage.failures.Store(1)
+	resp = post(body)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, int32(4), storage.stored.Load())
+	// and a rate-limited sample is dropped instead of a retry later
+	body = promWriteRequest(
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "3"}, promSample{22, now}),
+		promSeries(map[string]string{"__name__": "node_hwmon_temp_celsius", "sensor_id": "1"}, promSample{21, now + 3000}),
+	)
+	resp = post(body)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, int32(5), storage.stored.Load())
+}
@@ -4,50 +4,225 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/valyala/fasthttp"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/netip"
+	"sensord/internal/certs"
+	"sensord/internal/core"
 	"sensord/internal/db"
+	"sensord/internal/logging"
+	"sensord/internal/metrics"
 	"sensord/internal/models"
+	"sensord/internal/sensor_status"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SensorApiServer Collects measurements from sensors
 type SensorApiServer struct {
-	storage    db.SensorsDb
-	listenAddr string
+	storage     db.SensorsDb
+	listenAddr  string
+	tlsCert     string
+	tlsKey      string
+	tlsClientCa string
+	// tlsCerts the current certificate replaced by a reload or nil if TLS is disabled
+	tlsCerts *certs.Store
+	// rules of the ingestion replaced by a reload
+	rules        atomic.Pointer[ingestRules]
+	deduplicator *deduplicator
+	decompressor *decompressor
+	registry     *sensor_status.Registry
+	// logSampler limits logs of ingest errors
+	logSampler *logging.Sampler
+	// remoteWrite mapping of Prometheus series or nil if the remote-write is disabled
+	remoteWrite *remoteWriteMapping
+	// otlp mapping of OpenTelemetry gauges or nil if the OTLP receiver is disabled
+	otlp *otlpMapping
+	// limits of the server against slow and hostile clients
+	maxBodySize   int
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	maxConns      int
+	maxConnsPerIp int
+	httpServer    *fasthttp.Server
 }
 
-func NewSensorApiServer(ListenAddr string, storage db.SensorsDb) *SensorApiServer {
-	return &SensorApiServer{
-		listenAddr: ListenAddr,
-		storage:    storage,
+// measurementPool reuses measurements of single requests to avoid allocations on the hot path
+var measurementPool = sync.Pool{
+	New: func() any {
+		return &models.MeasurementDto{}
+	},
+}
+
+func NewSensorApiServer(conf *core.SensordConf, storage db.SensorsDb, registry *sensor_status.Registry) *SensorApiServer {
+	s := &SensorApiServer{
+		listenAddr:    conf.SensorApiListenHttp,
+		storage:       storage,
+		tlsCert:       conf.SensorTlsCert,
+		tlsKey:        conf.SensorTlsKey,
+		tlsClientCa:   conf.SensorTlsClientCa,
+		deduplicator:  newDeduplicator(conf.DedupWindow, conf.DedupMaxEntries),
+		decompressor:  newDecompressor(conf.SensorMaxDecompressedSize),
+		registry:      registry,
+		logSampler:    logging.NewSampler(conf.LogSampleBurst, conf.LogSampleInterval),
+		remoteWrite:   newRemoteWriteMapping(conf.RemoteWriteSensorLabel, conf.RemoteWriteMetrics),
+		otlp:          newOtlpMapping(conf.OtlpSensorAttribute, conf.OtlpMetrics),
+		maxBodySize:   conf.SensorMaxBodySize,
+		readTimeout:   conf.SensorReadTimeout,
+		writeTimeout:  conf.SensorWriteTimeout,
+		idleTimeout:   conf.SensorIdleTimeout,
+		maxConns:      conf.SensorMaxConns,
+		maxConnsPerIp: conf.SensorMaxConnsPerIp,
+	}
+	s.rules.Store(newIngestRules(conf, nil))
+	if conf.SensorTlsCert != "" {
+		s.tlsCerts = &certs.Store{}
 	}
+	s.httpServer = s.newHttpServer()
+	return s
 }
 
 func (s *SensorApiServer) Start() {
-	log.Printf("NOTICE: Start sensord API server on %s\n", s.listenAddr)
-	apiServerHttp := &fasthttp.Server{
+	slog.Info("Start sensord API server", "addr", s.listenAddr)
+	var err error
+	if s.tlsCerts != nil {
+		tlsConfig, tlsErr := certs.Load(s.tlsCert, s.tlsKey, s.tlsClientCa)
+		if tlsErr != nil {
+			logging.Fatal("API server TLS error", "err", tlsErr)
+		}
+		s.tlsCerts.Set(tlsConfig)
+		// the certificate is taken from the store so a reload replaces it
+		s.httpServer.TLSConfig = s.tlsCerts.ServerConfig()
+		err = s.httpServer.ListenAndServeTLS(s.listenAddr, "", "")
+	} else {
+		err = s.httpServer.ListenAndServe(s.listenAddr)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		logging.Fatal("API server http shutdown error", "err", err)
+	}
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests until the ctx is done.
+// Idle keep-alive connections are closed.
+func (s *SensorApiServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.ShutdownWithContext(ctx)
+}
+
+// saturationThreshold of connections when the sensor API stops to be ready
+const saturationThreshold = 0.9
+
+// CheckSaturation fails when the connections are close to the maxConns and new sensors would be rejected
+func (s *SensorApiServer) CheckSaturation(ctx context.Context) error {
+	if s.maxConns <= 0 {
+		return nil
+	}
+	conns := s.httpServer.GetCurrentConcurrency()
+	if float64(conns) >= saturationThreshold*float64(s.maxConns) {
+		return fmt.Errorf("saturated: %d of %d connections", conns, s.maxConns)
+	}
+	return nil
+}
+
+// newHttpServer with limits so slow or hostile clients can't exhaust connections and memory
+func (s *SensorApiServer) newHttpServer() *fasthttp.Server {
+	return &fasthttp.Server{
 		Handler:                       s.handleApiRequest,
 		DisableHeaderNamesNormalizing: true,
 		NoDefaultServerHeader:         true,
 		NoDefaultContentType:          true,
 		NoDefaultDate:                 true,
 		DisablePreParseMultipartForm:  true, // we don't use multipart forms but exploits may use it
+		MaxRequestBodySize:            s.maxBodySize,
+		ReadTimeout:                   s.readTimeout,
+		WriteTimeout:                  s.writeTimeout,
+		IdleTimeout:                   s.idleTimeout,
+		Concurrency:                   s.maxConns,
+		MaxConnsPerIP:                 s.maxConnsPerIp,
+		ErrorHandler:                  handleHttpError,
+		// ask clients to reconnect to another instance during the drain
+		CloseOnShutdown: true,
 	}
-	err := apiServerHttp.ListenAndServe(s.listenAddr)
-	if err != nil && err != http.ErrServerClosed {
-		log.Fatalf("CRIT: API server http shutdown error: %s\n", err)
+}
+
+// handleHttpError responds to a request that couldn't be read
+func handleHttpError(reqCtx *fasthttp.RequestCtx, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, fasthttp.ErrBodyTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+		reject(metrics.ReasonTooLarge, 1)
+	}
+	reqCtx.Response.SetStatusCode(status)
+	metrics.CountRequest(metricsServer, handlerOf(reqCtx.Path()), status)
+}
+
+var (
+	apiEndpoint      = []byte("/api/v1/measurement")
+	apiBatchEndpoint = []byte("/api/v1/measurements")
+	// remoteWriteEndpoint of the Prometheus remote-write protocol
+	remoteWriteEndpoint = []byte("/api/v1/write")
+	// otlpEndpoint of the OpenTelemetry OTLP/HTTP metrics exporter
+	otlpEndpoint = []byte("/v1/metrics")
+)
+
+// metricsServer the server label of the requests metrics
+const metricsServer = "sensor"
+
+// handlerOf the URL path for the requests metrics
+func handlerOf(path []byte) string {
+	switch {
+	case bytes.Equal(path, apiEndpoint):
+		return "measurement"
+	case bytes.Equal(path, apiBatchEndpoint):
+		return "measurements"
+	case bytes.Equal(path, remoteWriteEndpoint):
+		return "write"
+	case bytes.Equal(path, otlpEndpoint):
+		return "otlp"
+	default:
+		return metrics.HandlerOther
 	}
 }
 
-var apiEndpoint = []byte("/api/v1/measurement")
+// reject counts n rejected measurements by the reason
+func reject(reason string, n int) {
+	metrics.MeasurementsRejected.WithLabelValues(reason).Add(float64(n))
+}
+
+// rejectReasonOf the status of a failed authentication
+func rejectReasonOf(status int) string {
+	if status == http.StatusForbidden {
+		return metrics.ReasonForbidden
+	}
+	return metrics.ReasonUnauthorized
+}
+
+// RuleBatchSize the batch is empty or too large
+const RuleBatchSize = "batch_size"
+
+// maxBatchSize limits how many measurements may be sent in one batch
+const maxBatchSize = 1000
 
 func (s *SensorApiServer) handleApiRequest(reqCtx *fasthttp.RequestCtx) {
+	ctx, span := startRequestSpan(reqCtx)
+	ctx = logging.WithRequestId(ctx, requestIdOf(reqCtx))
+	// count and end the span after the panic is caught
+	defer func() {
+		status := reqCtx.Response.StatusCode()
+		metrics.CountRequest(metricsServer, handlerOf(reqCtx.Path()), status)
+		endRequestSpan(span, status)
+	}()
 	// catch panic
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			log.Printf("ERR: Unexpected error %s\n", panicErr)
+			slog.ErrorContext(ctx, "Unexpected error", "err", panicErr)
 			reqCtx.Response.SetStatusCode(http.StatusInternalServerError)
 		}
 	}()
@@ -55,41 +230,498 @@ func (s *SensorApiServer) handleApiRequest(reqCtx *fasthttp.RequestCtx) {
 	uri := reqCtx.Request.URI()
 	path := uri.Path()
 
-	// if path is /api/v1/measurement
-	if bytes.Equal(path, apiEndpoint) {
+	// if path is /api/v1/measurement, /api/v1/measurements, /api/v1/write or /v1/metrics
+	batch := bytes.Equal(path, apiBatchEndpoint)
+	remoteWrite := s.remoteWrite != nil && bytes.Equal(path, remoteWriteEndpoint)
+	otlp := s.otlp != nil && bytes.Equal(path, otlpEndpoint)
+	if batch || remoteWrite || otlp || bytes.Equal(path, apiEndpoint) {
 		// only POST is allowed
 		if !reqCtx.IsPost() {
 			reqCtx.Response.SetStatusCode(http.StatusMethodNotAllowed)
 			return
 		}
-		// Get the request body
-		body, err := reqCtx.Request.BodyUncompressed()
-		if err != nil {
-			reqCtx.Response.SetStatusCode(http.StatusUnprocessableEntity)
+		// check the source IP before spending anything on the request
+		clientAddr, _ := netip.AddrFromSlice(reqCtx.RemoteIP())
+		if allowed, retryAfter := s.rules.Load().ipLimiter.allow(ipLimitKey(clientAddr)); !allowed {
+			reject(metrics.ReasonRateLimited, 1)
+			tooManyRequests(reqCtx, retryAfter)
+			return
+		}
+		if remoteWrite {
+			s.handleRemoteWrite(ctx, reqCtx)
 			return
 		}
-		// parse the JSON and save
-		err = s.parseAndStore(body)
+		contentType := reqCtx.Request.Header.ContentType()
+		var format *payloadFormat
+		var otlpJson, supported bool
+		if otlp {
+			// OTLP has its own JSON and Protobuf encodings
+			otlpJson, supported = otlpEncodingOf(contentType)
+		} else {
+			format = payloadFormatOf(contentType)
+			supported = format != nil
+		}
+		if !supported {
+			reject(metrics.ReasonUnsupportedMedia, 1)
+			reqCtx.Response.SetStatusCode(http.StatusUnsupportedMediaType)
+			return
+		}
+		// Get the request body
+		buf := bufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufferPool.Put(buf)
+		encoding := peekHeader(&reqCtx.Request.Header, contentEncodingHeader, contentEncodingHeaderLower)
+		_, decompressSpan := tracer.Start(ctx, "decompress")
+		body, err := s.decompressor.decompress(encoding, reqCtx.Request.Body(), buf)
+		decompressSpan.End()
 		if err != nil {
-			reqCtx.Response.SetStatusCode(http.StatusBadRequest)
+			switch err {
+			case ErrEncodingUnsupported:
+				reject(metrics.ReasonUnsupportedMedia, 1)
+				reqCtx.Response.Header.Set("Accept-Encoding", supportedEncodings)
+				reqCtx.Response.SetStatusCode(http.StatusUnsupportedMediaType)
+			case ErrBodyTooLarge:
+				reject(metrics.ReasonTooLarge, 1)
+				reqCtx.Response.SetStatusCode(http.StatusRequestEntityTooLarge)
+			default:
+				reject(RuleMalformed, 1)
+				reqCtx.Response.SetStatusCode(http.StatusUnprocessableEntity)
+			}
 			return
 		}
-
-		reqCtx.Response.SetStatusCode(http.StatusNoContent)
+		switch {
+		case otlp:
+			s.handleOtlp(ctx, reqCtx, otlpJson, body)
+		case batch:
+			s.handleBatch(ctx, reqCtx, format, body)
+		default:
+			s.handleMeasurement(ctx, reqCtx, format, body)
+		}
 		return
 	}
 	// 404 for the unknown URL path
 	reqCtx.Response.SetStatusCode(http.StatusNotFound)
 }
 
-func (s *SensorApiServer) parseAndStore(body []byte) error {
-	ctx := context.Background()
-	measurement := &models.MeasurementDto{}
-	err := json.Unmarshal(body, measurement)
+// handleMeasurement stores a single measurement
+func (s *SensorApiServer) handleMeasurement(ctx context.Context, reqCtx *fasthttp.RequestCtx, format *payloadFormat, body []byte) {
+	measurement := measurementPool.Get().(*models.MeasurementDto)
+	*measurement = models.MeasurementDto{}
+	defer measurementPool.Put(measurement)
+	rules := s.rules.Load()
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	err := format.decode(body, measurement, rules.strictDecoding)
+	decodeSpan.End()
 	if err != nil {
-		return err
+		reject(RuleMalformed, 1)
+		badRequest(reqCtx, &ValidationError{RuleMalformed, err.Error()})
+		return
 	}
-	s.storage.StoreMeasurement(ctx, measurement.Time, measurement.SensorId, measurement.Value)
+	setDefaults(measurement)
+	// the sensor's time and the key before a late measurement is re-timestamped
+	sensorTime := measurement.Time
+	dedupKey := dedupKeyOf(measurement, rules.validator.serverTime(measurement))
+	validationErr := rules.validator.validate(measurement)
+	if validationErr != nil {
+		reject(validationErr.Rule, 1)
+		badRequest(reqCtx, validationErr)
+		return
+	}
+	status := s.authenticate(ctx, reqCtx, measurement.SensorId, body)
+	if status != 0 {
+		reject(rejectReasonOf(status), 1)
+		reqCtx.Response.SetStatusCode(status)
+		return
+	}
+	status, retryAfter := s.ingest(ctx, measurement, sensorTime, dedupKey)
+	switch status {
+	case http.StatusTooManyRequests:
+		tooManyRequests(reqCtx, retryAfter)
+	case http.StatusNoContent:
+		setAppliedTime(reqCtx, measurement)
+		reqCtx.Response.SetStatusCode(status)
+	default:
+		reqCtx.Response.SetStatusCode(status)
+	}
+}
 
-	return nil
+// handleBatch stores a batch of measurements e.g. a backlog of a sensor or a gateway.
+// The batch is signed as a whole so each signed sensor of the batch is verified with the same signature.
+// Each measurement is validated and stored separately and the response lists rejected ones.
+func (s *SensorApiServer) handleBatch(ctx context.Context, reqCtx *fasthttp.RequestCtx, format *payloadFormat, body []byte) {
+	rules := s.rules.Load()
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	measurements, err := format.decodeBatch(body, rules.strictDecoding)
+	decodeSpan.End()
+	if err != nil {
+		reject(RuleMalformed, 1)
+		badRequest(reqCtx, &ValidationError{RuleMalformed, err.Error()})
+		return
+	}
+	if len(measurements) == 0 || len(measurements) > maxBatchSize {
+		reject(RuleBatchSize, 1)
+		badRequest(reqCtx, &ValidationError{RuleBatchSize,
+			fmt.Sprintf("batch must have from 1 to %d measurements", maxBatchSize)})
+		return
+	}
+	for _, measurement := range measurements {
+		if measurement == nil {
+			reject(RuleMalformed, len(measurements))
+			badRequest(reqCtx, &ValidationError{RuleMalformed, "measurement is null"})
+			return
+		}
+		setDefaults(measurement)
+	}
+	// a batch with a forged measurement is rejected as a whole
+	authenticated := make(map[int]bool, 1)
+	for _, measurement := range measurements {
+		if authenticated[measurement.SensorId] {
+			continue
+		}
+		status := s.authenticate(ctx, reqCtx, measurement.SensorId, body)
+		if status != 0 {
+			reject(rejectReasonOf(status), len(measurements))
+			reqCtx.Response.SetStatusCode(status)
+			return
+		}
+		authenticated[measurement.SensorId] = true
+	}
+	result := &models.BatchResultDto{}
+	var maxRetryAfter time.Duration
+	for i, measurement := range measurements {
+		sensorTime := measurement.Time
+		dedupKey := dedupKeyOf(measurement, rules.validator.serverTime(measurement))
+		validationErr := rules.validator.validate(measurement)
+		if validationErr != nil {
+			reject(validationErr.Rule, 1)
+			result.Rejected = append(result.Rejected, &models.RejectedDto{
+				Index:   i,
+				Status:  http.StatusBadRequest,
+				Rule:    validationErr.Rule,
+				Message: validationErr.Message,
+			})
+			continue
+		}
+		status, retryAfter := s.ingest(ctx, measurement, sensorTime, dedupKey)
+		if status != http.StatusNoContent {
+			result.Rejected = append(result.Rejected, &models.RejectedDto{Index: i, Status: status})
+			if retryAfter > maxRetryAfter {
+				maxRetryAfter = retryAfter
+			}
+			continue
+		}
+		result.Accepted++
+	}
+	if maxRetryAfter > 0 {
+		setRetryAfter(reqCtx, maxRetryAfter)
+	}
+	jsonBody, _ := json.Marshal(result)
+	reqCtx.Response.Header.SetContentType("application/json;charset=utf-8")
+	reqCtx.Response.SetStatusCode(http.StatusOK)
+	reqCtx.Response.SetBody(jsonBody)
+}
+
+// handleRemoteWrite stores samples of the Prometheus remote-write request.
+// Samples are folded into the daily aggregates like measurements. Invalid samples are skipped and counted
+// because Prometheus drops the whole request on 4xx. If the DB fails then 503 asks Prometheus to retry the request,
+// see the ingestRetried, and if a sensor's rate limit is exceeded then 429 asks it to retry later.
+func (s *SensorApiServer) handleRemoteWrite(ctx context.Context, reqCtx *fasthttp.RequestCtx) {
+	encoding := peekHeader(&reqCtx.Request.Header, contentEncodingHeader, contentEncodingHeaderLower)
+	if !equalFold(bytes.TrimSpace(encoding), "snappy") {
+		reject(metrics.ReasonUnsupportedMedia, 1)
+		reqCtx.Response.Header.Set("Accept-Encoding", "snappy")
+		reqCtx.Response.SetStatusCode(http.StatusUnsupportedMediaType)
+		return
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+	msg, err := decodeSnappy(reqCtx.Request.Body(), buf, s.decompressor.maxSize)
+	if err == ErrRemoteWriteTooLarge {
+		reject(metrics.ReasonTooLarge, 1)
+		reqCtx.Response.SetStatusCode(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		reject(RuleMalformed, 1)
+		badRequest(reqCtx, &ValidationError{RuleMalformed, err.Error()})
+		return
+	}
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	measurements, err := s.remoteWrite.decode(msg)
+	decodeSpan.End()
+	if err != nil {
+		reject(RuleMalformed, 1)
+		badRequest(reqCtx, &ValidationError{RuleMalformed, err.Error()})
+		return
+	}
+	// sensors with a secret or a bound certificate can't be written by Prometheus
+	authenticated := make(map[int]bool, 1)
+	for _, measurement := range measurements {
+		if authenticated[measurement.SensorId] {
+			continue
+		}
+		status := s.authenticate(ctx, reqCtx, measurement.SensorId, msg)
+		if status != 0 {
+			reject(rejectReasonOf(status), len(measurements))
+			reqCtx.Response.SetStatusCode(status)
+			return
+		}
+		authenticated[measurement.SensorId] = true
+	}
+	retry, maxRetryAfter := s.ingestRetried(ctx, measurements, func(int, *ValidationError) {})
+	if retry {
+		reqCtx.Response.SetStatusCode(http.StatusServiceUnavailable)
+		return
+	}
+	if maxRetryAfter > 0 {
+		setRetryAfter(reqCtx, maxRetryAfter)
+		reqCtx.Response.SetStatusCode(http.StatusTooManyRequests)
+		return
+	}
+	reqCtx.Response.SetStatusCode(http.StatusNoContent)
+}
+
+// handleOtlp stores gauge data points of the OpenTelemetry OTLP/HTTP metrics export.
+// Points that can't be measurements are rejected and listed in the partial success because
+// the exporter doesn't retry a 4xx. If the DB fails then 503 asks the exporter to retry the request, see the ingestRetried.
+func (s *SensorApiServer) handleOtlp(ctx context.Context, reqCtx *fasthttp.RequestCtx, jsonEncoded bool, body []byte) {
+	var points []*otlpPoint
+	var err error
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	if jsonEncoded {
+		points, err = s.otlp.decodeOtlpJson(body)
+	} else {
+		points, err = s.otlp.decodeOtlpProtobuf(body)
+	}
+	decodeSpan.End()
+	if err != nil {
+		reject(RuleMalformed, 1)
+		badRequest(reqCtx, &ValidationError{RuleMalformed, err.Error()})
+		return
+	}
+	partialSuccess := &otlpPartialSuccess{}
+	measurements := make([]*models.MeasurementDto, len(points))
+	for i, point := range points {
+		measurement, validationErr := s.otlp.toMeasurement(point)
+		if validationErr != nil {
+			reject(validationErr.Rule, 1)
+			partialSuccess.reject(point, validationErr)
+			continue
+		}
+		measurements[i] = measurement
+	}
+	// sensors with a secret or a bound certificate can't be written by the collector
+	authenticated := make(map[int]bool, 1)
+	for _, measurement := range measurements {
+		if measurement == nil || authenticated[measurement.SensorId] {
+			continue
+		}
+		status := s.authenticate(ctx, reqCtx, measurement.SensorId, body)
+		if status != 0 {
+			reject(rejectReasonOf(status), len(points))
+			reqCtx.Response.SetStatusCode(status)
+			return
+		}
+		authenticated[measurement.SensorId] = true
+	}
+	retry, _ := s.ingestRetried(ctx, measurements, func(i int, validationErr *ValidationError) {
+		partialSuccess.reject(points[i], validationErr)
+	})
+	if retry {
+		reqCtx.Response.SetStatusCode(http.StatusServiceUnavailable)
+		return
+	}
+	if jsonEncoded {
+		reqCtx.Response.Header.SetContentType("application/json")
+		reqCtx.Response.SetBody(partialSuccess.encodeJson())
+	} else {
+		reqCtx.Response.Header.SetContentType("application/x-protobuf")
+		reqCtx.Response.SetBody(partialSuccess.encodeProtobuf())
+	}
+	reqCtx.Response.SetStatusCode(http.StatusOK)
+}
+
+// ingestRetried stores the measurements of a request that the client retries as a whole on 503
+// e.g. the remote-write and the OTLP. Nil measurements are skipped.
+// If the DB fails then it returns true, so the client retries the request and the DEDUP_WINDOW, which is required
+// by these endpoints, skips the already stored measurements. A stored measurement stamped with the server time
+// can't be skipped, so after it the request isn't retried: the failed and the rest of measurements are dropped instead.
+// The rejected is called for each invalid, rate-limited or dropped measurement.
+// Returns the longest time to wait of the rate-limited ones or 0 if the request can't be retried.
+func (s *SensorApiServer) ingestRetried(ctx context.Context, measurements []*models.MeasurementDto, rejected func(i int, validationErr *ValidationError)) (bool, time.Duration) {
+	rules := s.rules.Load()
+	retrySafe := true
+	storageFailed := false
+	var maxRetryAfter time.Duration
+	for i, measurement := range measurements {
+		if measurement == nil {
+			continue
+		}
+		if storageFailed {
+			reject(metrics.ReasonStorageError, 1)
+			rejected(i, &ValidationError{metrics.ReasonStorageError, "unable to store"})
+			continue
+		}
+		sensorTime := measurement.Time
+		dedupKey := dedupKeyOf(measurement, rules.validator.serverTime(measurement))
+		validationErr := rules.validator.validate(measurement)
+		if validationErr != nil {
+			reject(validationErr.Rule, 1)
+			rejected(i, validationErr)
+			continue
+		}
+		status, retryAfter := s.ingest(ctx, measurement, sensorTime, dedupKey)
+		switch status {
+		case http.StatusNoContent:
+			if dedupKey == noDedupKey {
+				retrySafe = false
+			}
+		case http.StatusServiceUnavailable:
+			if retrySafe {
+				return true, 0
+			}
+			storageFailed = true
+			rejected(i, &ValidationError{metrics.ReasonStorageError, "unable to store"})
+		case http.StatusTooManyRequests:
+			rejected(i, &ValidationError{metrics.ReasonRateLimited, "sensor's rate limit is exceeded"})
+			if retryAfter > maxRetryAfter {
+				maxRetryAfter = retryAfter
+			}
+		}
+	}
+	if !retrySafe {
+		return false, 0
+	}
+	return false, maxRetryAfter
+}
+
+// authenticate the sensor by the request signature and the client certificate.
+// Returns 0 if the sensor is allowed to write or an HTTP status otherwise.
+func (s *SensorApiServer) authenticate(ctx context.Context, reqCtx *fasthttp.RequestCtx, sensorId int, body []byte) int {
+	rules := s.rules.Load()
+	// check the signature if the sensor has a shared secret
+	err := rules.hmacVerifier.verify(sensorId, &reqCtx.Request.Header, body)
+	if err != nil {
+		s.logSampled(ctx, slog.LevelWarn, "sensor:"+strconv.Itoa(sensorId), "Rejected measurement", "sensor_id", sensorId, "err", err)
+		return http.StatusUnauthorized
+	}
+	// the client certificate can only write as its own sensor
+	if rules.bindSensor && !certMatchesSensor(reqCtx.TLSConnectionState(), sensorId) {
+		s.logSampled(ctx, slog.LevelWarn, "sensor:"+strconv.Itoa(sensorId), "Rejected measurement",
+			"sensor_id", sensorId, "err", "client certificate is issued for another sensor")
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// ingest stores a valid and authenticated measurement.
+// Returns 204 if the measurement was stored or it's a retry, 429 with a time to wait or 503 if the DB failed.
+func (s *SensorApiServer) ingest(ctx context.Context, measurement *models.MeasurementDto, sensorTime time.Time, dedupKey dedupKey) (int, time.Duration) {
+	// limit after the authentication so a spoofed sensorId can't exhaust the sensor's limit
+	if allowed, retryAfter := s.rules.Load().sensorLimiter.allow(measurement.SensorId); !allowed {
+		reject(metrics.ReasonRateLimited, 1)
+		return http.StatusTooManyRequests, retryAfter
+	}
+	// a retry of already stored measurement is accepted but not counted twice
+	duplicate, err := s.deduplicator.isDuplicate(ctx, dedupKey)
+	if err != nil {
+		// the first attempt is still being stored
+		return http.StatusServiceUnavailable, 0
+	}
+	if duplicate {
+		return http.StatusNoContent, 0
+	}
+	// a failed one isn't remembered to let the sensor retry. Deferred so a panic doesn't block retries.
+	stored := false
+	defer func() {
+		s.deduplicator.done(dedupKey, stored)
+	}()
+	err = s.storage.StoreMeasurement(ctx, measurement.Time, measurement.SensorId, measurement.Metric, measurement.Value, measurement.Flags)
+	if err != nil {
+		s.logSampled(ctx, slog.LevelError, "storage", "Unable to store measurement", "sensor_id", measurement.SensorId, "err", err)
+		reject(metrics.ReasonStorageError, 1)
+		return http.StatusServiceUnavailable, 0
+	}
+	stored = true
+	metrics.MeasurementsAccepted.Inc()
+	s.registry.Observe(measurement.SensorId, sensorTime, time.Now(), measurement.Flags)
+	if !measurement.Flags.Has(models.FlagLate) {
+		s.registry.ObserveValue(measurement.SensorId, measurement.Metric, measurement.Value)
+	}
+	return http.StatusNoContent, 0
+}
+
+// logSampled logs an ingest error unless the key e.g. the sensor has logged too many in the interval.
+// The first log after suppressed ones tells how many were suppressed.
+func (s *SensorApiServer) logSampled(ctx context.Context, level slog.Level, key string, msg string, args ...any) {
+	allowed, suppressed := s.logSampler.Allow(key)
+	if !allowed {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Log(ctx, level, msg, args...)
+}
+
+var (
+	requestIdHeader      = []byte("X-Request-Id")
+	requestIdHeaderLower = []byte("x-request-id")
+)
+
+// requestIdOf the request is the caller's X-Request-Id or a new one. It's returned in the response.
+func requestIdOf(reqCtx *fasthttp.RequestCtx) string {
+	var requestId string
+	if callerId := peekHeader(&reqCtx.Request.Header, requestIdHeader, requestIdHeaderLower); logging.ValidRequestId(callerId) {
+		requestId = string(callerId)
+	} else {
+		requestId = logging.NewRequestId()
+	}
+	reqCtx.Response.Header.SetBytesK(requestIdHeader, requestId)
+	return requestId
+}
+
+// setAppliedTime tells the sensor which timestamp was stored: its own or the server receive time
+func setAppliedTime(reqCtx *fasthttp.RequestCtx, measurement *models.MeasurementDto) {
+	var buf [64]byte
+	reqCtx.Response.Header.SetBytesV("X-Measurement-Time", measurement.Time.AppendFormat(buf[:0], time.RFC3339Nano))
+	if measurement.Flags.Has(models.FlagServerTime) {
+		reqCtx.Response.Header.Set("X-Time-Source", "server")
+	} else {
+		reqCtx.Response.Header.Set("X-Time-Source", "sensor")
+	}
+}
+
+// badRequest responds with 400 and a JSON body with the failed rule
+func badRequest(reqCtx *fasthttp.RequestCtx, validationErr *ValidationError) {
+	errorDto := &models.ErrorDto{
+		Rule:    validationErr.Rule,
+		Message: validationErr.Message,
+	}
+	jsonBody, _ := json.Marshal(errorDto)
+	reqCtx.Response.Header.SetContentType("application/json;charset=utf-8")
+	reqCtx.Response.SetStatusCode(http.StatusBadRequest)
+	reqCtx.Response.SetBody(jsonBody)
+}
+
+// tooManyRequests responds with 429 and the Retry-After in seconds
+func tooManyRequests(reqCtx *fasthttp.RequestCtx, retryAfter time.Duration) {
+	setRetryAfter(reqCtx, retryAfter)
+	reqCtx.Response.SetStatusCode(http.StatusTooManyRequests)
+}
+
+func setRetryAfter(reqCtx *fasthttp.RequestCtx, retryAfter time.Duration) {
+	retryAfterSec := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSec < 1 {
+		retryAfterSec = 1
+	}
+	reqCtx.Response.Header.Set("Retry-After", strconv.Itoa(retryAfterSec))
+}
+
+// setDefaults of optional fields
+func setDefaults(measurement *models.MeasurementDto) {
+	if measurement.Metric == "" {
+		measurement.Metric = models.DefaultMetric
+	}
 }
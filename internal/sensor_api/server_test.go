@@ -0,0 +1,403 @@
+package sensor_api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+	"net/http"
+	"sensord/internal/core"
+	"sensord/internal/db"
+	"sensord/internal/metrics"
+	"sensord/internal/models"
+	"sensord/internal/sensor_status"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer serves the Sensor API with the limits on a random port
+func startTestServer(t *testing.T, s *SensorApiServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := s.newHttpServer()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return listener.Addr().String()
+}
+
+func newLimitedServer() *SensorApiServer {
+	return &SensorApiServer{
+		maxBodySize:  100,
+		readTimeout:  200 * time.Millisecond,
+		writeTimeout: 200 * time.Millisecond,
+		idleTimeout:  200 * time.Millisecond,
+		maxConns:     10,
+	}
+}
+
+// waitClosed returns true if the server closed the connection before the deadline
+func waitClosed(conn net.Conn, deadline time.Duration) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(deadline))
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err != nil {
+			netErr, isNetErr := err.(net.Error)
+			return !isNetErr || !netErr.Timeout()
+		}
+	}
+}
+
+func Test_newHttpServer_SlowHeaders(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer())
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// slowloris: send a header line from time to time and never finish the request
+	_, err = conn.Write([]byte("POST /api/v1/measurement HTTP/1.1\r\nHost: sensord\r\n"))
+	assert.NoError(t, err)
+	go func() {
+		for i := 0; i < 20; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := conn.Write([]byte("X-Slow: 1\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	assert.True(t, waitClosed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_newHttpServer_SlowBody(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer())
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /api/v1/measurement HTTP/1.1\r\nHost: sensord\r\nContent-Length: 50\r\n\r\n{"))
+	assert.NoError(t, err)
+	start := time.Now()
+	assert.True(t, waitClosed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_newHttpServer_IdleConnection(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer())
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	assert.True(t, waitClosed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func Test_newHttpServer_BodyTooLarge(t *testing.T) {
+	addr := startTestServer(t, newLimitedServer())
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("POST /api/v1/measurement HTTP/1.1\r\nHost: sensord\r\nContent-Length: 1000\r\n\r\n"))
+	assert.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func Test_newHttpServer_MaxConnsPerIp(t *testing.T) {
+	s := newLimitedServer()
+	s.maxConnsPerIp = 1
+	addr := startTestServer(t, s)
+	first, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer first.Close()
+	// let the server accept the first connection
+	time.Sleep(50 * time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer second.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+// blockingStorage holds StoreMeasurement until released
+type blockingStorage struct {
+	db.SensorsDb
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) StoreMeasurement(_ context.Context, _ time.Time, _ int, _ string, _ float64, _ models.MeasurementFlags) error {
+	close(s.started)
+	<-s.release
+	return nil
+}
+
+// startStorageServer serves the Sensor API with the storage on a random port.
+// The configure funcs change the default test config.
+func startStorageServer(t *testing.T, storage db.SensorsDb, configure ...func(conf *core.SensordConf)) (*SensorApiServer, net.Listener) {
+	conf := &core.SensordConf{
+		SensorIdMin:               1,
+		SensorIdMax:               100,
+		MaxClockSkew:              time.Minute,
+		SensorMaxDecompressedSize: 1000,
+		SensorMaxBodySize:         1000,
+		SensorReadTimeout:         time.Second,
+		SensorWriteTimeout:        time.Second,
+		SensorIdleTimeout:         time.Second,
+		SensorMaxConns:            10,
+	}
+	for _, configureFunc := range configure {
+		configureFunc(conf)
+	}
+	s := NewSensorApiServer(conf, storage, sensor_status.NewRegistry())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = s.httpServer.Serve(listener)
+	}()
+	return s, listener
+}
+
+func Test_SensorApiServer_Shutdown(t *testing.T) {
+	storage := &blockingStorage{started: make(chan struct{}), release: make(chan struct{})}
+	s, listener := startStorageServer(t, storage)
+	url := "http://" + listener.Addr().String() + "/api/v1/measurement"
+
+	// in-flight request
+	respStatus := make(chan int)
+	go func() {
+		resp, err := http.Post(url, "application/json", strings.NewReader(`{"sensorId":1,"value":20}`))
+		if err != nil {
+			respStatus <- 0
+			return
+		}
+		respStatus <- resp.StatusCode
+	}()
+	<-storage.started
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+	// waits for the in-flight request
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown didn't wait for the in-flight request")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// new connections are refused
+	_, err := net.DialTimeout("tcp", listener.Addr().String(), 100*time.Millisecond)
+	assert.Error(t, err)
+
+	close(storage.release)
+	assert.Equal(t, http.StatusNoContent, <-respStatus)
+	assert.NoError(t, <-shutdownErr)
+}
+
+func Test_SensorApiServer_Shutdown_Deadline(t *testing.T) {
+	storage := &blockingStorage{started: make(chan struct{}), release: make(chan struct{})}
+	s, listener := startStorageServer(t, storage)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = http.Post("http://"+listener.Addr().String()+"/api/v1/measurement", "application/json", strings.NewReader(`{"sensorId":1,"value":20}`))
+	}()
+	<-storage.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	// the request isn't counted in the metrics of the next test
+	close(storage.release)
+	<-done
+}
+
+func Test_SensorApiServer_CheckSaturation(t *testing.T) {
+	s, listener := startStorageServer(t, nil)
+	defer s.Shutdown(context.Background())
+	assert.NoError(t, s.CheckSaturation(context.Background()))
+
+	// 9 of 10 connections are busy
+	for i := 0; i < 9; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.ErrorContains(t, s.CheckSaturation(context.Background()), "saturated")
+}
+
+// memoryStorage accepts all measurements
+type memoryStorage struct {
+	db.SensorsDb
+}
+
+func (s *memoryStorage) StoreMeasurement(_ context.Context, _ time.Time, _ int, _ string, _ float64, _ models.MeasurementFlags) error {
+	return nil
+}
+
+// countingStorage counts stored measurements
+type countingStorage struct {
+	db.SensorsDb
+	stored atomic.Int32
+}
+
+func (s *countingStorage) StoreMeasurement(_ context.Context, _ time.Time, _ int, _ string, _ float64, _ models.MeasurementFlags) error {
+	s.stored.Add(1)
+	return nil
+}
+
+// failingStorage fails to store the next failures measurements of the failSensorId
+type failingStorage struct {
+	countingStorage
+	failSensorId int
+	failures     atomic.Int32
+}
+
+func (s *failingStorage) StoreMeasurement(ctx context.Context, time time.Time, sensorId int, metric string, value float64, flags models.MeasurementFlags) error {
+	if sensorId == s.failSensorId && s.failures.Add(-1) >= 0 {
+		return errors.New("connection refused")
+	}
+	return s.countingStorage.StoreMeasurement(ctx, time, sensorId, metric, value, flags)
+}
+
+func Test_SensorApiServer_DedupServerTime(t *testing.T) {
+	storage := &countingStorage{}
+	s, listener := startStorageServer(t, storage, func(conf *core.SensordConf) {
+		conf.DedupWindow = time.Minute
+		conf.DedupMaxEntries = 100
+	})
+	defer s.Shutdown(context.Background())
+	url := "http://" + listener.Addr().String() + "/api/v1/measurement"
+
+	// readings of a sensor without a clock are different readings, not retries
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(url, "application/json", strings.NewReader(fmt.Sprintf(`{"sensorId":1,"value":2%d}`, i)))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "server", resp.Header.Get("X-Time-Source"))
+	}
+	assert.Equal(t, int32(3), storage.stored.Load())
+
+	// a retry with the measurementId is still skipped
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(url, "application/json", strings.NewReader(`{"sensorId":1,"value":20,"measurementId":"m1"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	assert.Equal(t, int32(4), storage.stored.Load())
+}
+
+func Test_SensorApiServer_Metrics(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+	baseUrl := "http://" + listener.Addr().String()
+	accepted := testutil.ToFloat64(metrics.MeasurementsAccepted)
+	rejected := testutil.ToFloat64(metrics.MeasurementsRejected.WithLabelValues(RuleSensorId))
+	created := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("sensor", "measurement", "204"))
+	notFound := testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("sensor", metrics.HandlerOther, "404"))
+
+	resp, err := http.Post(baseUrl+"/api/v1/measurement", "application/json", strings.NewReader(`{"sensorId":1,"value":20}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, err = http.Post(baseUrl+"/api/v1/measurement", "application/json", strings.NewReader(`{"sensorId":1000,"value":20}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = http.Post(baseUrl+"/wp-login.php", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	assert.Equal(t, accepted+1, testutil.ToFloat64(metrics.MeasurementsAccepted))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(metrics.MeasurementsRejected.WithLabelValues(RuleSensorId)))
+	assert.Equal(t, created+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("sensor", "measurement", "204")))
+	// unknown paths share one series
+	assert.Equal(t, notFound+1, testutil.ToFloat64(metrics.HttpRequests.WithLabelValues("sensor", metrics.HandlerOther, "404")))
+}
+
+func Test_SensorApiServer_IpRateLimit(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{}, func(conf *core.SensordConf) {
+		conf.SensorIpRateLimit = 0.01
+		conf.SensorIpRateBurst = 1
+	})
+	defer s.Shutdown(context.Background())
+	url := "http://" + listener.Addr().String() + "/api/v1/measurement"
+	rateLimited := testutil.ToFloat64(metrics.MeasurementsRejected.WithLabelValues(metrics.ReasonRateLimited))
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"sensorId":1,"value":20}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"sensorId":2,"value":20}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	// operators alert on the Prometheus counter
+	assert.Equal(t, rateLimited+1, testutil.ToFloat64(metrics.MeasurementsRejected.WithLabelValues(metrics.ReasonRateLimited)))
+}
+
+func Test_SensorApiServer_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// other tests expect the tracing to be disabled
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/api/v1/measurement",
+		strings.NewReader(`{"sensorId":1,"value":20}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 3)
+	requestSpan := spans[len(spans)-1]
+	assert.Equal(t, "POST /api/v1/measurement", requestSpan.Name())
+	// the caller's trace is continued
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", requestSpan.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", requestSpan.Parent().SpanID().String())
+	assert.Contains(t, requestSpan.Attributes(), semconv.HTTPStatusCode(http.StatusNoContent))
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, requestSpan.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
+
+func Test_SensorApiServer_RequestId(t *testing.T) {
+	s, listener := startStorageServer(t, &memoryStorage{})
+	defer s.Shutdown(context.Background())
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/api/v1/measurement",
+		strings.NewReader(`{"sensorId":1,"value":20}`))
+	req.Header.Set("X-Request-Id", "f47ac10b-58cc-4372-a567-0e02b2c3d479")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "f47ac10b-58cc-4372-a567-0e02b2c3d479", resp.Header.Get("X-Request-Id"))
+
+	req.Header.Del("X-Request-Id")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.Header.Get("X-Request-Id"))
+}
@@ -0,0 +1,25 @@
+package sensor_api
+
+import (
+	"crypto/tls"
+	"strconv"
+)
+
+// certMatchesSensor checks that the verified client certificate was issued for the sensor.
+// The sensorId must be equal to the certificate's Common Name or one of the DNS SANs.
+func certMatchesSensor(connState *tls.ConnectionState, sensorId int) bool {
+	if connState == nil || len(connState.VerifiedChains) == 0 || len(connState.VerifiedChains[0]) == 0 {
+		return false
+	}
+	clientCert := connState.VerifiedChains[0][0]
+	sensorIdStr := strconv.Itoa(sensorId)
+	if clientCert.Subject.CommonName == sensorIdStr {
+		return true
+	}
+	for _, dnsName := range clientCert.DNSNames {
+		if dnsName == sensorIdStr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package sensor_api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_certMatchesSensor(t *testing.T) {
+	connStateFor := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	byCommonName := connStateFor(&x509.Certificate{Subject: pkix.Name{CommonName: "1"}})
+	assert.True(t, certMatchesSensor(byCommonName, 1))
+	assert.False(t, certMatchesSensor(byCommonName, 2))
+
+	bySan := connStateFor(&x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}, DNSNames: []string{"7", "8"}})
+	assert.True(t, certMatchesSensor(bySan, 8))
+	assert.False(t, certMatchesSensor(bySan, 1))
+
+	// plain HTTP or not verified certificate
+	assert.False(t, certMatchesSensor(nil, 1))
+	assert.False(t, certMatchesSensor(&tls.ConnectionState{}, 1))
+}
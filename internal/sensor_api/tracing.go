@@ -0,0 +1,85 @@
+package sensor_api
+
+import (
+	"context"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sensord/internal/metrics"
+)
+
+var tracer = otel.Tracer("sensord/internal/sensor_api")
+
+// defaultTracerProvider the global provider until the tracing.Init sets one. Its spans aren't recorded.
+var defaultTracerProvider = otel.GetTracerProvider()
+
+// tracingEnabled returns false if the spans of the global tracer provider aren't recorded,
+// so the ingest hot path doesn't allocate span names and attributes that are thrown away.
+func tracingEnabled() bool {
+	provider := otel.GetTracerProvider()
+	return provider != defaultTracerProvider && provider != trace.NewNoopTracerProvider()
+}
+
+var (
+	traceparentHeader      = []byte("Traceparent")
+	traceparentHeaderLower = []byte("traceparent")
+)
+
+// headerCarrier reads the W3C trace context from the request headers.
+// The header names are not normalized so both the canonical and the lowercase names are looked up.
+type headerCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c headerCarrier) Get(key string) string {
+	return string(peekHeader(c.header, []byte(http.CanonicalHeaderKey(key)), []byte(key)))
+}
+
+// Set does nothing: the request headers are not changed
+func (c headerCarrier) Set(string, string) {
+}
+
+func (c headerCarrier) Keys() []string {
+	return nil
+}
+
+// startRequestSpan continues the caller's trace if the request has the traceparent header.
+// The context isn't the reqCtx so a stored measurement isn't canceled by the server shutdown.
+func startRequestSpan(reqCtx *fasthttp.RequestCtx) (context.Context, trace.Span) {
+	enabled := tracingEnabled()
+	ctx := context.Background()
+	// without tracing the caller's trace id is still logged, but most sensors don't send one
+	if enabled || peekHeader(&reqCtx.Request.Header, traceparentHeader, traceparentHeaderLower) != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier{&reqCtx.Request.Header})
+	}
+	if !enabled {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	// unknown URLs don't make new span names
+	route := metrics.HandlerOther
+	if handlerOf(reqCtx.Path()) != metrics.HandlerOther {
+		route = string(reqCtx.Path())
+	}
+	return tracer.Start(ctx, string(reqCtx.Method())+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(string(reqCtx.Method())),
+			semconv.HTTPRoute(route),
+		))
+}
+
+// endRequestSpan with the response status. Only 5xx are errors of the server.
+func endRequestSpan(span trace.Span, status int) {
+	if !span.IsRecording() {
+		span.End()
+		return
+	}
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,131 @@
+package sensor_api
+
+import (
+	"fmt"
+	"math"
+	"sensord/internal/core"
+	"sensord/internal/models"
+	"sensord/internal/units"
+	"time"
+)
+
+// Validation rules
+const (
+	RuleMalformed     = "malformed"
+	RuleSensorId      = "sensor_id_range"
+	RuleMetric        = "metric_unknown"
+	RuleUnit          = "unit_unknown"
+	RuleMeasurementId = "measurement_id_length"
+	RuleTimeFuture    = "time_future"
+	RuleTimeLate      = "time_late"
+	RuleValueFinite   = "value_finite"
+	RuleValueRange    = "value_range"
+)
+
+// maxMeasurementIdLen limits memory used by the de-duplication
+const maxMeasurementIdLen = 64
+
+// ValidationError describes which rule the measurement failed
+type ValidationError struct {
+	Rule    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Rule + ": " + e.Message
+}
+
+// validator checks that a measurement is plausible
+type validator struct {
+	sensorIdMin int
+	sensorIdMax int
+	valueRanges map[string]core.ValueRange
+	sensorUnits map[int]string
+	maxSkew     time.Duration
+	maxLateness time.Duration
+	latePolicy  core.LatePolicy
+	// serverTimeSensors have no clock and are always stamped with the server time
+	serverTimeSensors map[int]bool
+	now               func() time.Time
+}
+
+func newValidator(conf *core.SensordConf) *validator {
+	return &validator{
+		sensorIdMin:       conf.SensorIdMin,
+		sensorIdMax:       conf.SensorIdMax,
+		valueRanges:       conf.ValueRanges,
+		sensorUnits:       conf.SensorUnits,
+		maxSkew:           conf.MaxClockSkew,
+		maxLateness:       conf.MaxLateness,
+		latePolicy:        conf.LatePolicy,
+		serverTimeSensors: conf.ServerTimeSensors,
+		now:               time.Now,
+	}
+}
+
+// serverTime returns true if the measurement will be stamped with the server time
+func (v *validator) serverTime(measurement *models.MeasurementDto) bool {
+	return measurement.Time.IsZero() || v.serverTimeSensors[measurement.SensorId]
+}
+
+// validate returns nil if the measurement is valid.
+// The value is converted to the metric's unit so all aggregates of the metric have the same unit.
+// A measurement without a time is stamped with the server time.
+// A late measurement is flagged or re-timestamped according to the late policy.
+func (v *validator) validate(measurement *models.MeasurementDto) *ValidationError {
+	if measurement.SensorId < v.sensorIdMin || measurement.SensorId > v.sensorIdMax {
+		return &ValidationError{RuleSensorId,
+			fmt.Sprintf("sensorId %d is outside of [%d, %d]", measurement.SensorId, v.sensorIdMin, v.sensorIdMax)}
+	}
+	if len(measurement.MeasurementId) > maxMeasurementIdLen {
+		return &ValidationError{RuleMeasurementId,
+			fmt.Sprintf("measurementId is longer than %d", maxMeasurementIdLen)}
+	}
+	unit, found := models.MetricUnits[measurement.Metric]
+	if !found {
+		return &ValidationError{RuleMetric, fmt.Sprintf("metric %q is unknown", measurement.Metric)}
+	}
+	if measurement.Unit == "" {
+		measurement.Unit = v.sensorUnits[measurement.SensorId]
+	}
+	if measurement.Unit != "" && measurement.Unit != unit {
+		conversion, found := units.Find(measurement.Unit, unit)
+		if !found {
+			return &ValidationError{RuleUnit,
+				fmt.Sprintf("unit %q is unknown or can't be converted to %s", measurement.Unit, unit)}
+		}
+		measurement.Value = conversion.Convert(measurement.Value)
+	}
+	measurement.Unit = unit
+	now := v.now()
+	// a sensor without a clock
+	if v.serverTime(measurement) {
+		measurement.Time = now
+		measurement.Flags |= models.FlagServerTime
+	}
+	if measurement.Time.After(now.Add(v.maxSkew)) {
+		return &ValidationError{RuleTimeFuture,
+			fmt.Sprintf("time %s is more than %s in the future", measurement.Time.Format(time.RFC3339), v.maxSkew)}
+	}
+	if v.maxLateness > 0 && measurement.Time.Before(now.Add(-v.maxLateness)) {
+		switch v.latePolicy {
+		case core.LatePolicyFlag:
+			measurement.Flags |= models.FlagLate
+		case core.LatePolicyRetimestamp:
+			measurement.Flags |= models.FlagLate | models.FlagServerTime
+			measurement.Time = now
+		default:
+			return &ValidationError{RuleTimeLate,
+				fmt.Sprintf("time %s is more than %s in the past", measurement.Time.Format(time.RFC3339), v.maxLateness)}
+		}
+	}
+	if math.IsNaN(measurement.Value) || math.IsInf(measurement.Value, 0) {
+		return &ValidationError{RuleValueFinite, "value must be a finite number"}
+	}
+	valueRange, found := v.valueRanges[unit]
+	if found && (measurement.Value < valueRange.Min || measurement.Value > valueRange.Max) {
+		return &ValidationError{RuleValueRange,
+			fmt.Sprintf("value %g is outside of [%g, %g] %s", measurement.Value, valueRange.Min, valueRange.Max, unit)}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package sensor_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"sensord/internal/core"
+	"sensord/internal/models"
+	"testing"
+	"time"
+)
+
+func Test_validator_validate(t *testing.T) {
+	now := time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC)
+	v := newValidator(&core.SensordConf{
+		SensorIdMin:  1,
+		SensorIdMax:  1000,
+		ValueRanges:  map[string]core.ValueRange{"celsius": {Min: -50, Max: 60}, "percent": {Min: 0, Max: 100}},
+		MaxClockSkew: time.Minute,
+		MaxLateness:  24 * time.Hour,
+	})
+	v.now = func() time.Time { return now }
+
+	tests := []struct {
+		name         string
+		measurement  *models.MeasurementDto
+		expectedRule string
+	}{
+		{"valid", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now, Value: 21.5}, ""},
+		{"negative sensor", &models.MeasurementDto{Metric: "temperature", SensorId: -1, Time: now, Value: 21.5}, RuleSensorId},
+		{"too big sensor", &models.MeasurementDto{Metric: "temperature", SensorId: 1001, Time: now, Value: 21.5}, RuleSensorId},
+		{"skew", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now.Add(30 * time.Second), Value: 21.5}, ""},
+		{"future", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now.Add(2 * time.Minute), Value: 21.5}, RuleTimeFuture},
+		{"late", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now.AddDate(0, 0, -2), Value: 21.5}, RuleTimeLate},
+		{"NaN", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now, Value: math.NaN()}, RuleValueFinite},
+		{"Inf", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now, Value: math.Inf(1)}, RuleValueFinite},
+		{"absurd", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now, Value: 10000}, RuleValueRange},
+		{"min", &models.MeasurementDto{Metric: "temperature", SensorId: 1, Time: now, Value: -50}, ""},
+		{"unknown metric", &models.MeasurementDto{Metric: "noise", SensorId: 1, Time: now, Value: 1}, RuleMetric},
+		{"humidity", &models.MeasurementDto{Metric: "humidity", SensorId: 1, Time: now, Value: 99}, ""},
+		{"humidity range", &models.MeasurementDto{Metric: "humidity", SensorId: 1, Time: now, Value: 101}, RuleValueRange},
+	}
+	for _, tt := range tests {
+		validationErr := v.validate(tt.measurement)
+		if tt.expectedRule == "" {
+			assert.Nil(t, validationErr, tt.name)
+		} else if assert.NotNil(t, validationErr, tt.name) {
+			assert.Equal(t, tt.expectedRule, validationErr.Rule, tt.name)
+		}
+	}
+}
+
+func Test_validator_validate_Units(t *testing.T) {
+	now := time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC)
+	v := newValidator(&core.SensordConf{
+		SensorIdMin:  1,
+		SensorIdMax:  1000,
+		ValueRanges:  map[string]core.ValueRange{"celsius": {Min: -50, Max: 60}},
+		SensorUnits:  map[int]string{2: "fahrenheit"},
+		MaxClockSkew: time.Minute,
+	})
+	v.now = func() time.Time { return now }
+
+	// the metric's unit by default
+	measurement := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: now, Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, "celsius", measurement.Unit)
+	assert.Equal(t, 20.0, measurement.Value)
+
+	// the sensor's default unit
+	measurement = &models.MeasurementDto{SensorId: 2, Metric: "temperature", Time: now, Value: 122}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, "celsius", measurement.Unit)
+	assert.InDelta(t, 50.0, measurement.Value, 1e-9)
+
+	// the unit from the payload wins. The range is checked after conversion
+	measurement = &models.MeasurementDto{SensorId: 2, Metric: "temperature", Unit: "kelvin", Time: now, Value: 400}
+	validationErr := v.validate(measurement)
+	assert.Equal(t, RuleValueRange, validationErr.Rule)
+
+	measurement = &models.MeasurementDto{SensorId: 1, Metric: "temperature", Unit: "ppm", Time: now, Value: 20}
+	validationErr = v.validate(measurement)
+	assert.Equal(t, RuleUnit, validationErr.Rule)
+}
+
+func Test_validator_validate_LatePolicy(t *testing.T) {
+	now := time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC)
+	lateTime := now.AddDate(0, 0, -2)
+	conf := &core.SensordConf{
+		SensorIdMin:  1,
+		SensorIdMax:  1000,
+		MaxClockSkew: time.Minute,
+		MaxLateness:  24 * time.Hour,
+		LatePolicy:   core.LatePolicyFlag,
+	}
+	v := newValidator(conf)
+	v.now = func() time.Time { return now }
+	measurement := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: lateTime, Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, models.FlagLate, measurement.Flags)
+	assert.Equal(t, lateTime, measurement.Time)
+
+	conf.LatePolicy = core.LatePolicyRetimestamp
+	v = newValidator(conf)
+	v.now = func() time.Time { return now }
+	measurement = &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: lateTime, Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, models.FlagLate|models.FlagServerTime, measurement.Flags)
+	assert.Equal(t, now, measurement.Time)
+
+	// not late
+	measurement = &models.MeasurementDto{SensorId: 1, Metric: "temperature", Time: now, Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, models.MeasurementFlags(0), measurement.Flags)
+}
+
+func Test_validator_validate_ServerTime(t *testing.T) {
+	now := time.Date(2023, 10, 3, 12, 0, 0, 0, time.UTC)
+	v := newValidator(&core.SensordConf{
+		SensorIdMin:       1,
+		SensorIdMax:       1000,
+		MaxClockSkew:      time.Minute,
+		ServerTimeSensors: map[int]bool{2: true},
+	})
+	v.now = func() time.Time { return now }
+
+	// no time
+	measurement := &models.MeasurementDto{SensorId: 1, Metric: "temperature", Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, now, measurement.Time)
+	assert.Equal(t, models.FlagServerTime, measurement.Flags)
+
+	// the sensor has no clock so it's time is ignored
+	measurement = &models.MeasurementDto{SensorId: 2, Metric: "temperature", Time: time.Unix(0, 0), Value: 20}
+	assert.Nil(t, v.validate(measurement))
+	assert.Equal(t, now, measurement.Time)
+	assert.Equal(t, models.FlagServerTime, measurement.Flags)
+}
@@ -0,0 +1,121 @@
+package sensor_status
+
+import (
+	"sensord/internal/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxTrackedSensors keeps the memory bounded if someone sends random sensor ids
+const MaxTrackedSensors = 100_000
+
+// offsetSmoothing weight of a new clock offset sample in the moving average
+const offsetSmoothing = 0.1
+
+// Registry tracks status of each sensor in memory. It's shared between the Sensor and Admin API.
+type Registry struct {
+	mu      sync.RWMutex
+	sensors map[int]*sensorState
+}
+
+type sensorState struct {
+	status models.SensorStatus
+	// clockOffset exponential moving average of the offset
+	clockOffset float64
+	// offsetSamples number of measurements used for the clockOffset
+	offsetSamples int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sensors: map[int]*sensorState{},
+	}
+}
+
+// Observe a measurement from the sensor. Late measurements are not used to estimate the clock offset
+// because a flushed backlog would look like a clock that is days behind.
+// Measurements stamped with the server time have no sensor time at all.
+func (r *Registry) Observe(sensorId int, sensorTime, receivedAt time.Time, flags models.MeasurementFlags) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, found := r.sensors[sensorId]
+	if !found {
+		if len(r.sensors) >= MaxTrackedSensors {
+			return
+		}
+		state = &sensorState{status: models.SensorStatus{SensorId: sensorId}}
+		r.sensors[sensorId] = state
+	}
+	state.status.LastSeen = receivedAt
+	state.status.MeasurementCount++
+	if flags.Has(models.FlagLate) {
+		state.status.LateCount++
+	}
+	if flags.Has(models.FlagServerTime) {
+		state.status.ServerTimeCount++
+	}
+	if flags != 0 {
+		return
+	}
+	offset := float64(receivedAt.Sub(sensorTime))
+	state.offsetSamples++
+	if state.offsetSamples == 1 {
+		state.clockOffset = offset
+	} else {
+		state.clockOffset += offsetSmoothing * (offset - state.clockOffset)
+	}
+	state.status.ClockOffsetMs = time.Duration(state.clockOffset).Milliseconds()
+}
+
+// ObserveValue remembers the latest value of the sensor's metric.
+// Call it after the Observe and not for late measurements: they are older than the current value.
+func (r *Registry) ObserveValue(sensorId int, metric string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, found := r.sensors[sensorId]
+	if !found {
+		return
+	}
+	if state.status.LastValues == nil {
+		state.status.LastValues = map[string]float64{}
+	}
+	state.status.LastValues[metric] = value
+}
+
+// copyStatus so the caller doesn't share the LastValues map with the registry
+func (state *sensorState) copyStatus() *models.SensorStatus {
+	status := state.status
+	if state.status.LastValues != nil {
+		status.LastValues = make(map[string]float64, len(state.status.LastValues))
+		for metric, value := range state.status.LastValues {
+			status.LastValues[metric] = value
+		}
+	}
+	return &status
+}
+
+// Get a copy of the sensor status or nil if the sensor wasn't seen
+func (r *Registry) Get(sensorId int) *models.SensorStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	state, found := r.sensors[sensorId]
+	if !found {
+		return nil
+	}
+	return state.copyStatus()
+}
+
+// List copies of all sensors statuses ordered by sensor id
+func (r *Registry) List() []*models.SensorStatus {
+	r.mu.RLock()
+	statuses := make([]*models.SensorStatus, 0, len(r.sensors))
+	for _, state := range r.sensors {
+		statuses = append(statuses, state.copyStatus())
+	}
+	r.mu.RUnlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].SensorId < statuses[j].SensorId
+	})
+	return statuses
+}
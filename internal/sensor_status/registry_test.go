@@ -0,0 +1,67 @@
+package sensor_status
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sensord/internal/models"
+	"testing"
+	"time"
+)
+
+func Test_Registry_Observe(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	registry := NewRegistry()
+	assert.Nil(t, registry.Get(1))
+
+	// the sensor clock is 2 seconds behind
+	registry.Observe(1, now.Add(-2*time.Second), now, 0)
+	status := registry.Get(1)
+	assert.Equal(t, int64(2000), status.ClockOffsetMs)
+	assert.Equal(t, now, status.LastSeen)
+
+	// a late backlog doesn't change the estimate
+	registry.Observe(1, now.AddDate(0, 0, -3), now.Add(time.Second), models.FlagLate)
+	status = registry.Get(1)
+	assert.Equal(t, int64(2000), status.ClockOffsetMs)
+	assert.Equal(t, int64(2), status.MeasurementCount)
+	assert.Equal(t, int64(1), status.LateCount)
+	assert.Equal(t, now.Add(time.Second), status.LastSeen)
+
+	// moving average
+	registry.Observe(1, now.Add(2*time.Second), now.Add(2*time.Second), 0)
+	status = registry.Get(1)
+	assert.Equal(t, int64(1800), status.ClockOffsetMs)
+
+	// no sensor time
+	registry.Observe(1, now.Add(3*time.Second), now.Add(3*time.Second), models.FlagServerTime)
+	status = registry.Get(1)
+	assert.Equal(t, int64(1800), status.ClockOffsetMs)
+	assert.Equal(t, int64(1), status.ServerTimeCount)
+
+	registry.Observe(3, now, now, 0)
+	registry.Observe(2, now, now, 0)
+	statuses := registry.List()
+	assert.Len(t, statuses, 3)
+	assert.Equal(t, 1, statuses[0].SensorId)
+	assert.Equal(t, 2, statuses[1].SensorId)
+	assert.Equal(t, 3, statuses[2].SensorId)
+}
+
+func Test_Registry_ObserveValue(t *testing.T) {
+	now := time.Date(2023, 10, 3, 0, 0, 0, 0, time.UTC)
+	registry := NewRegistry()
+	// unknown sensor
+	registry.ObserveValue(1, "temperature", 20)
+	assert.Nil(t, registry.Get(1))
+
+	registry.Observe(1, now, now, 0)
+	assert.Nil(t, registry.Get(1).LastValues)
+	registry.ObserveValue(1, "temperature", 20)
+	registry.ObserveValue(1, "temperature", 21.5)
+	registry.ObserveValue(1, "humidity", 40)
+	status := registry.Get(1)
+	assert.Equal(t, map[string]float64{"temperature": 21.5, "humidity": 40}, status.LastValues)
+
+	// the copy doesn't share the map
+	status.LastValues["temperature"] = 0
+	assert.Equal(t, 21.5, registry.List()[0].LastValues["temperature"])
+}
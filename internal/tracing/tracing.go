@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"sensord/internal/core"
+)
+
+// serviceName of the sensord in traces. The OTEL_SERVICE_NAME overrides it.
+const serviceName = "sensord"
+
+// Init sets the global tracer provider and the W3C trace context propagator.
+// Returns a func to flush and stop the exporter on shutdown.
+// If tracing is disabled then the incoming trace context is still propagated to outgoing calls and logs.
+func Init(ctx context.Context, exporterType core.TracingExporter, sampleRatio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterType {
+	case core.TracingExporterOtlp:
+		// the endpoint, headers and TLS are set by the standard OTEL_EXPORTER_OTLP_* envs
+		exporter, err = otlptracehttp.New(ctx)
+	case core.TracingExporterStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create the span exporter")
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to detect the trace resource")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// follow the caller's decision so its traces are not broken
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Fail marks the span as failed with the error and returns the error
+func Fail(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
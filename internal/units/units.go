@@ -0,0 +1,116 @@
+package units
+
+import (
+	"sensord/internal/models"
+)
+
+// Conversion is an affine conversion of a value to another unit: `Scale * value + Offset`
+type Conversion struct {
+	Scale  float64
+	Offset float64
+}
+
+// Convert the value
+func (c Conversion) Convert(value float64) float64 {
+	return c.Scale*value + c.Offset
+}
+
+// Inverse returns the conversion back to the original unit
+func (c Conversion) Inverse() Conversion {
+	return Conversion{
+		Scale:  1 / c.Scale,
+		Offset: -c.Offset / c.Scale,
+	}
+}
+
+// ConvertStats converts aggregated stats in place.
+// The affine conversion is applied to the sum for each measurement so the offset is added count times.
+// The variance doesn't depend on the offset and is scaled by the square of the scale.
+func (c Conversion) ConvertStats(rec *models.MeasurementRec) {
+	rec.TotalSum = c.Scale*rec.TotalSum + c.Offset*float64(rec.TotalCount)
+	rec.AvgValue = c.Convert(rec.AvgValue)
+	if rec.Variance != nil {
+		variance := c.Scale * c.Scale * *rec.Variance
+		rec.Variance = &variance
+	}
+	minValue, maxValue := c.Convert(rec.MinValue), c.Convert(rec.MaxValue)
+	// a negative scale swaps min and max
+	if minValue > maxValue {
+		minValue, maxValue = maxValue, minValue
+	}
+	rec.MinValue, rec.MaxValue = minValue, maxValue
+}
+
+// unit of measurement with a conversion to its canonical unit
+type unit struct {
+	canonical   string
+	toCanonical Conversion
+}
+
+// knownUnits the canonical units are ones from the models.MetricUnits
+var knownUnits = map[string]unit{
+	"celsius":    {"celsius", Conversion{1, 0}},
+	"fahrenheit": {"celsius", Conversion{5.0 / 9.0, -32 * 5.0 / 9.0}},
+	"kelvin":     {"celsius", Conversion{1, -273.15}},
+	"percent":    {"percent", Conversion{1, 0}},
+	"ppm":        {"ppm", Conversion{1, 0}},
+	"hpa":        {"hpa", Conversion{1, 0}},
+	"pa":         {"hpa", Conversion{0.01, 0}},
+	"kpa":        {"hpa", Conversion{10, 0}},
+	"mbar":       {"hpa", Conversion{1, 0}},
+	"bar":        {"hpa", Conversion{1000, 0}},
+	"psi":        {"hpa", Conversion{68.94757293168, 0}},
+	"inhg":       {"hpa", Conversion{33.86388666, 0}},
+}
+
+// IsKnown returns true if the unit is supported
+func IsKnown(unitName string) bool {
+	_, found := knownUnits[unitName]
+	return found
+}
+
+// Names of all supported units
+func Names() []string {
+	names := make([]string, 0, len(knownUnits))
+	for name := range knownUnits {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Find a conversion between the units. Returns false if the units measure different things e.g. celsius and ppm.
+func Find(from, to string) (Conversion, bool) {
+	fromUnit, fromFound := knownUnits[from]
+	toUnit, toFound := knownUnits[to]
+	if !fromFound || !toFound || fromUnit.canonical != toUnit.canonical {
+		return Conversion{}, false
+	}
+	fromCanonical := fromUnit.toCanonical
+	canonicalTo := toUnit.toCanonical.Inverse()
+	return Conversion{
+		Scale:  canonicalTo.Scale * fromCanonical.Scale,
+		Offset: canonicalTo.Scale*fromCanonical.Offset + canonicalTo.Offset,
+	}, true
+}
+
+// ucumUnits the UCUM codes of OpenTelemetry metrics
+var ucumUnits = map[string]string{
+	"Cel":       "celsius",
+	"[degF]":    "fahrenheit",
+	"K":         "kelvin",
+	"%":         "percent",
+	"[ppm]":     "ppm",
+	"hPa":       "hpa",
+	"Pa":        "pa",
+	"kPa":       "kpa",
+	"mbar":      "mbar",
+	"bar":       "bar",
+	"[psi]":     "psi",
+	"[in_i'Hg]": "inhg",
+}
+
+// FromUcum returns the unit of the UCUM code e.g. `Cel` is the celsius. Returns false for unknown codes.
+func FromUcum(code string) (string, bool) {
+	unitName, found := ucumUnits[code]
+	return unitName, found
+}
@@ -0,0 +1,81 @@
+package units
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sensord/internal/models"
+	"testing"
+)
+
+func Test_Find(t *testing.T) {
+	conv, found := Find("fahrenheit", "celsius")
+	assert.True(t, found)
+	assert.InDelta(t, 100.0, conv.Convert(212), 1e-9)
+	assert.InDelta(t, 0.0, conv.Convert(32), 1e-9)
+
+	conv, found = Find("celsius", "fahrenheit")
+	assert.True(t, found)
+	assert.InDelta(t, 212.0, conv.Convert(100), 1e-9)
+
+	conv, found = Find("kelvin", "fahrenheit")
+	assert.True(t, found)
+	assert.InDelta(t, 32.0, conv.Convert(273.15), 1e-9)
+
+	conv, found = Find("bar", "pa")
+	assert.True(t, found)
+	assert.InDelta(t, 100_000.0, conv.Convert(1), 1e-6)
+
+	_, found = Find("celsius", "ppm")
+	assert.False(t, found)
+	_, found = Find("celsius", "unknown")
+	assert.False(t, found)
+}
+
+func Test_ConvertStats(t *testing.T) {
+	// measurements 0, 10 and 20 celsius
+	variance := 200.0 / 3
+	rec := &models.MeasurementRec{
+		TotalCount: 3,
+		TotalSum:   30,
+		AvgValue:   10,
+		Variance:   &variance,
+		MinValue:   0,
+		MaxValue:   20,
+	}
+	conv, _ := Find("celsius", "fahrenheit")
+	conv.ConvertStats(rec)
+	// the same measurements in fahrenheit 32, 50 and 68
+	assert.Equal(t, int64(3), rec.TotalCount)
+	assert.InDelta(t, 150.0, rec.TotalSum, 1e-9)
+	assert.InDelta(t, 50.0, rec.AvgValue, 1e-9)
+	assert.InDelta(t, (18.0*18+18*18)/3, *rec.Variance, 1e-9)
+	// the input isn't modified
+	assert.InDelta(t, 200.0/3, variance, 1e-9)
+	assert.InDelta(t, 32.0, rec.MinValue, 1e-9)
+	assert.InDelta(t, 68.0, rec.MaxValue, 1e-9)
+
+	// negative scale swaps min and max
+	Conversion{Scale: -1}.ConvertStats(rec)
+	assert.InDelta(t, -68.0, rec.MinValue, 1e-9)
+	assert.InDelta(t, -32.0, rec.MaxValue, 1e-9)
+	// and keeps the variance positive
+	assert.InDelta(t, (18.0*18+18*18)/3, *rec.Variance, 1e-9)
+	Conversion{Scale: -2, Offset: 1}.ConvertStats(rec)
+	assert.InDelta(t, 4*(18.0*18+18*18)/3, *rec.Variance, 1e-9)
+
+	// days stored before the variance was tracked have no variance
+	rec = &models.MeasurementRec{TotalCount: 1, TotalSum: 10, AvgValue: 10, MinValue: 10, MaxValue: 10}
+	conv.ConvertStats(rec)
+	assert.Nil(t, rec.Variance)
+	assert.InDelta(t, 50.0, rec.AvgValue, 1e-9)
+}
+
+func Test_FromUcum(t *testing.T) {
+	unitName, found := FromUcum("Cel")
+	assert.True(t, found)
+	assert.Equal(t, "celsius", unitName)
+	for _, unitName := range ucumUnits {
+		assert.True(t, IsKnown(unitName), unitName)
+	}
+	_, found = FromUcum("celsius")
+	assert.False(t, found)
+}
@@ -0,0 +1,14 @@
+SET
+    search_path TO sensors;
+
+-- users of the Admin API
+CREATE TABLE admin_user
+(
+    username      TEXT PRIMARY KEY,
+    -- bcrypt hash
+    password_hash TEXT NOT NULL,
+    -- viewer: see reports, operator: also delete data, admin: also manage users and settings
+    role          TEXT NOT NULL CHECK (role IN ('viewer', 'operator', 'admin')),
+    -- sensors the user can see. NULL means all sensors
+    sensor_ids    INT[]
+);
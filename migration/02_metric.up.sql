@@ -0,0 +1,12 @@
+SET
+    search_path TO sensors;
+
+-- type of the measurement e.g. temperature, humidity, co2, pressure
+ALTER TABLE measurement
+    ADD COLUMN metric TEXT NOT NULL DEFAULT 'temperature';
+
+DROP INDEX idx_measurement;
+
+CREATE UNIQUE INDEX idx_measurement
+    ON measurement (measurement_day, sensor_id, metric)
+    INCLUDE (total_count, total_sum, avg_value, min_value, max_value);
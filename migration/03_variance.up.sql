@@ -0,0 +1,7 @@
+SET
+    search_path TO sensors;
+
+-- sum of squared deviations from the average (M2 of the Welford's method) to calculate a variance.
+-- NULL for existing days: their values are unknown so the variance can't be calculated.
+ALTER TABLE measurement
+    ADD COLUMN total_m2 DOUBLE PRECISION;
@@ -0,0 +1,6 @@
+SET
+    search_path TO sensors;
+
+-- number of measurements that arrived later than the lateness horizon but were stored with the late flag
+ALTER TABLE measurement
+    ADD COLUMN late_count BIGINT NOT NULL DEFAULT 0;
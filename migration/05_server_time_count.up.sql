@@ -0,0 +1,6 @@
+SET
+    search_path TO sensors;
+
+-- number of measurements stamped with the server receive time instead of the sensor time
+ALTER TABLE measurement
+    ADD COLUMN server_time_count BIGINT NOT NULL DEFAULT 0;